@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/albertwidi/akouste/downloader"
+	"github.com/albertwidi/akouste/pkg/storage/gcs"
+	"github.com/albertwidi/akouste/pkg/storage/local"
+	"github.com/albertwidi/akouste/pkg/storage/s3"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Error variables
+var (
+	ErrEmptyListen            = errors.New("empty listen address")
+	ErrUnknownBucketProto     = errors.New("unknown bucket protocol")
+	ErrEmptyDestPath          = errors.New("empty download directory")
+	ErrNegativeRetention      = errors.New("retention settings must not be negative")
+	ErrInvalidShutdownTimeout = errors.New("shutdown timeout must be positive")
+	ErrInvalidEnv             = errors.New("invalid environment variable")
+	ErrNegativeMinFreeSpace   = errors.New("minimum free space must not be negative")
+	ErrInvalidHookTimeout     = errors.New("hook timeout must be positive")
+)
+
+// envPrefix of the environment variables overriding the config file
+const envPrefix = "AKOUSTE_"
+
+// Config of the downloader binary. Settings are read from the -config YAML file, then from
+// the environment variables and then from the command-line flags, the last one wins.
+type Config struct {
+	// Address the API listens on
+	Listen          string        `yaml:"listen"`
+	LogLevel        string        `yaml:"log_level"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	Storage    StorageConfig    `yaml:"storage"`
+	Downloader DownloaderConfig `yaml:"downloader"`
+	Retention  RetentionConfig  `yaml:"retention"`
+	Health     HealthConfig     `yaml:"health"`
+	Hooks      HooksConfig      `yaml:"hooks"`
+	Webhook    WebhookConfig    `yaml:"webhook"`
+	Watch      WatchConfig      `yaml:"watch"`
+	TLS        TLSConfig        `yaml:"tls"`
+	Auth       AuthConfig       `yaml:"auth"`
+}
+
+// StorageConfig selects the storage provider, each provider has its own settings
+type StorageConfig struct {
+	// Provider/protocol of the bucket, 'gs', 's3' or 'local'
+	Proto string       `yaml:"proto"`
+	GCS   gcs.Config   `yaml:"gcs"`
+	S3    s3.Config    `yaml:"s3"`
+	Local local.Config `yaml:"local"`
+}
+
+// setBucket sets the bucket of every provider, only the one of Proto is used
+func (c *StorageConfig) setBucket(name string) {
+	c.GCS.Bucket = name
+	c.S3.Bucket = name
+	c.Local.Bucket = name
+}
+
+// DownloaderConfig holds the settings of the downloads
+type DownloaderConfig struct {
+	DestPath        string `yaml:"dest_path"`
+	ChecksumSidecar bool   `yaml:"checksum_sidecar"`
+	// Paths of the trusted public keys
+	TrustedKeys []string `yaml:"trusted_keys"`
+}
+
+// RetentionConfig holds the settings of the retention policies, zero values disable them
+type RetentionConfig struct {
+	KeepOldCount int           `yaml:"keep_old_count"`
+	KeepWithin   time.Duration `yaml:"keep_within"`
+	MaxTotalSize int64         `yaml:"max_total_size"`
+	Pinned       []string      `yaml:"pinned"`
+}
+
+// HealthConfig holds the settings of the readiness checks
+type HealthConfig struct {
+	// Free bytes DestPath must have, not checked when 0
+	MinFreeSpace         int64 `yaml:"min_free_space"`
+	RequireActiveVersion bool  `yaml:"require_active_version"`
+}
+
+// HooksConfig holds the hooks run after a version is activated
+type HooksConfig struct {
+	// Shell commands
+	Commands []string `yaml:"commands"`
+	// Signals as '<signal>:<pid or pidfile>'
+	Signals []string `yaml:"signals"`
+	// URLs the activated version is posted to
+	URLs              []string      `yaml:"urls"`
+	Timeout           time.Duration `yaml:"timeout"`
+	RollbackOnFailure bool          `yaml:"rollback_on_failure"`
+}
+
+// WebhookConfig holds the URLs the events are posted to, events are not sent when empty
+type WebhookConfig struct {
+	URLs []string `yaml:"urls"`
+	// Path of the secret the requests are signed with, unsigned when empty
+	SecretFile string `yaml:"secret_file"`
+}
+
+// WatchConfig holds the settings of the watch mode, enabled when Prefix is set
+type WatchConfig struct {
+	Prefix    string        `yaml:"prefix"`
+	Interval  time.Duration `yaml:"interval"`
+	OrderBy   string        `yaml:"order_by"`
+	Unarchive bool          `yaml:"unarchive"`
+}
+
+// downloaderConfig returns the watch settings of the downloader
+func (c WatchConfig) downloaderConfig() downloader.WatchConfig {
+	return downloader.WatchConfig{
+		Prefix:    c.Prefix,
+		Interval:  c.Interval,
+		OrderBy:   c.OrderBy,
+		Unarchive: c.Unarchive,
+	}
+}
+
+// TLSConfig holds the paths of the PEM files the API is served with, TLS is enabled when set
+type TLSConfig struct {
+	Cert           string        `yaml:"cert"`
+	Key            string        `yaml:"key"`
+	ClientCA       string        `yaml:"client_ca"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// enabled returns true if any TLS file is set
+func (c TLSConfig) enabled() bool {
+	return c.Cert != "" || c.Key != "" || c.ClientCA != ""
+}
+
+// AuthConfig holds the API tokens, the API is unauthenticated when TokensFile is empty
+type AuthConfig struct {
+	TokensFile string `yaml:"tokens_file"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:          ":9000",
+		LogLevel:        "info",
+		ShutdownTimeout: 30 * time.Second,
+		Retention: RetentionConfig{
+			KeepOldCount: 5,
+		},
+		Hooks: HooksConfig{
+			Timeout: time.Minute,
+		},
+		Watch: WatchConfig{
+			Interval:  time.Minute,
+			OrderBy:   downloader.WatchOrderName,
+			Unarchive: true,
+		},
+		TLS: TLSConfig{
+			ReloadInterval: time.Minute,
+		},
+	}
+}
+
+// Validate validates configuration
+func (c Config) Validate() error {
+	if c.Listen == "" {
+		return ErrEmptyListen
+	}
+	if c.ShutdownTimeout <= 0 {
+		return ErrInvalidShutdownTimeout
+	}
+
+	switch c.Storage.Proto {
+	case "gs":
+		if err := c.Storage.GCS.Validate(); err != nil {
+			return fmt.Errorf("storage.gcs: %s", err.Error())
+		}
+	case "s3":
+		if err := c.Storage.S3.Validate(); err != nil {
+			return fmt.Errorf("storage.s3: %s", err.Error())
+		}
+	case "local":
+		if err := c.Storage.Local.Validate(); err != nil {
+			return fmt.Errorf("storage.local: %s", err.Error())
+		}
+	default:
+		return fmt.Errorf("%s: %q", ErrUnknownBucketProto.Error(), c.Storage.Proto)
+	}
+
+	if c.Downloader.DestPath == "" {
+		return ErrEmptyDestPath
+	}
+	if c.Retention.KeepOldCount < 0 || c.Retention.KeepWithin < 0 || c.Retention.MaxTotalSize < 0 {
+		return ErrNegativeRetention
+	}
+	if c.Health.MinFreeSpace < 0 {
+		return ErrNegativeMinFreeSpace
+	}
+	if c.Hooks.Timeout <= 0 {
+		return ErrInvalidHookTimeout
+	}
+	if c.Watch.Prefix != "" {
+		if err := c.Watch.downloaderConfig().Validate(); err != nil {
+			return fmt.Errorf("watch: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// loadConfigFile reads the YAML file filename over config, unknown keys are errors
+func loadConfigFile(filename string, config *Config) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return fmt.Errorf("error parsing %s: %s", filename, err.Error())
+	}
+	return nil
+}
+
+// applyEnv overrides config with the environment variables named after the YAML keys,
+// e.g. AKOUSTE_STORAGE_GCS_BUCKET for storage.gcs.bucket. Lists are comma separated.
+func applyEnv(config *Config, lookupEnv func(string) (string, bool)) error {
+	return applyEnvFields(reflect.ValueOf(config).Elem(), envPrefix, lookupEnv)
+}
+
+func applyEnvFields(v reflect.Value, prefix string, lookupEnv func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		// Field names are lowercased when there is no tag, as the YAML decoder does
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		key := prefix + strings.ToUpper(name)
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnvFields(v.Field(i), key+"_", lookupEnv); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookupEnv(key)
+		if !ok {
+			continue
+		}
+		if err := setValue(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %s: %s", ErrInvalidEnv.Error(), key, err.Error())
+		}
+	}
+	return nil
+}
+
+// setValue parses value into v
+func setValue(v reflect.Value, value string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		values := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		v.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// override sets the setting of config given by the command-line flag name
+func (f *appFlag) override(config *Config, name string) {
+	switch name {
+	case "listen":
+		config.Listen = f.listen
+	case "logLevel":
+		config.LogLevel = f.logLevel
+	case "shutdownTimeout":
+		config.ShutdownTimeout = f.shutdownTimeout
+	case "bucketProto":
+		config.Storage.Proto = f.bucketProto
+	case "bucketName":
+		config.Storage.setBucket(f.bucketName)
+	case "s3Endpoint":
+		config.Storage.S3.Endpoint = f.s3Endpoint
+	case "s3Region":
+		config.Storage.S3.Region = f.s3Region
+	case "s3ForcePathStyle":
+		config.Storage.S3.ForcePathStyle = f.s3ForcePathStyle
+	case "s3DisableSSL":
+		config.Storage.S3.DisableSSL = f.s3DisableSSL
+	case "s3CredentialsFile":
+		config.Storage.S3.CredentialsFile = f.s3CredentialsFile
+	case "s3Profile":
+		config.Storage.S3.Profile = f.s3Profile
+	case "downloadDIR":
+		config.Downloader.DestPath = f.destPath
+	case "checksumSidecar":
+		config.Downloader.ChecksumSidecar = f.checksumSidecar
+	case "trustedKey":
+		config.Downloader.TrustedKeys = f.trustedKeys
+	case "keepOldCount":
+		config.Retention.KeepOldCount = f.keepOldCount
+	case "keepWithin":
+		config.Retention.KeepWithin = f.keepWithin
+	case "maxTotalSize":
+		config.Retention.MaxTotalSize = f.maxTotalSize
+	case "pin":
+		config.Retention.Pinned = f.pinned
+	case "minFreeSpace":
+		config.Health.MinFreeSpace = f.minFreeSpace
+	case "requireActiveVersion":
+		config.Health.RequireActiveVersion = f.requireActiveVersion
+	case "hookCommand":
+		config.Hooks.Commands = f.hookCommands
+	case "hookSignal":
+		config.Hooks.Signals = f.hookSignals
+	case "hookURL":
+		config.Hooks.URLs = f.hookURLs
+	case "hookTimeout":
+		config.Hooks.Timeout = f.hookTimeout
+	case "rollbackOnHookFailure":
+		config.Hooks.RollbackOnFailure = f.rollbackOnHookFailure
+	case "webhookURL":
+		config.Webhook.URLs = f.webhookURLs
+	case "webhookSecretFile":
+		config.Webhook.SecretFile = f.webhookSecretFile
+	case "watchPrefix":
+		config.Watch.Prefix = f.watchPrefix
+	case "watchInterval":
+		config.Watch.Interval = f.watchInterval
+	case "watchOrderBy":
+		config.Watch.OrderBy = f.watchOrderBy
+	case "watchUnarchive":
+		config.Watch.Unarchive = f.watchUnarchive
+	case "tlsCert":
+		config.TLS.Cert = f.tlsCert
+	case "tlsKey":
+		config.TLS.Key = f.tlsKey
+	case "tlsClientCA":
+		config.TLS.ClientCA = f.tlsClientCA
+	case "tlsReloadInterval":
+		config.TLS.ReloadInterval = f.tlsReloadInterval
+	case "authTokensFile":
+		config.Auth.TokensFile = f.authTokensFile
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/storage/gcs"
+	"github.com/albertwidi/akouste/pkg/storage/local"
+	"github.com/albertwidi/akouste/pkg/storage/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+listen: 127.0.0.1:9100
+shutdown_timeout: 1m
+storage:
+  proto: s3
+  s3:
+    region: us-east-1
+    endpoint: http://127.0.0.1:9001
+    bucket: configs
+    client_id: akouste
+    client_secret: secret
+    force_path_style: true
+downloader:
+  dest_path: /var/lib/akouste
+  trusted_keys: [/etc/akouste/release.pub]
+retention:
+  keep_within: 168h
+  pinned: [config-1]
+hooks:
+  commands: [systemctl reload app]
+  timeout: 10s
+webhook:
+  urls: [https://hooks.example.com/akouste]
+watch:
+  prefix: config-
+  order_by: modtime
+tls:
+  cert: /etc/akouste/tls/tls.crt
+  key: /etc/akouste/tls/tls.key
+auth:
+  tokens_file: /etc/akouste/tokens.json
+`
+
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "akouste-config")
+	assert.NoError(t, err)
+	filename := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	return filename, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	filename, cleanup := writeConfig(t, testConfig)
+	defer cleanup()
+
+	config := defaultConfig()
+	assert.NoError(t, loadConfigFile(filename, &config))
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, Config{
+		Listen:          "127.0.0.1:9100",
+		LogLevel:        "info",
+		ShutdownTimeout: time.Minute,
+		Storage: StorageConfig{
+			Proto: "s3",
+			S3: s3.Config{
+				Region:         "us-east-1",
+				Endpoint:       "http://127.0.0.1:9001",
+				Bucket:         "configs",
+				ClientID:       "akouste",
+				ClientSecret:   "secret",
+				ForcePathStyle: true,
+			},
+		},
+		Downloader: DownloaderConfig{
+			DestPath:    "/var/lib/akouste",
+			TrustedKeys: []string{"/etc/akouste/release.pub"},
+		},
+		Retention: RetentionConfig{
+			KeepOldCount: 5,
+			KeepWithin:   7 * 24 * time.Hour,
+			Pinned:       []string{"config-1"},
+		},
+		Hooks: HooksConfig{
+			Commands: []string{"systemctl reload app"},
+			Timeout:  10 * time.Second,
+		},
+		Webhook: WebhookConfig{
+			URLs: []string{"https://hooks.example.com/akouste"},
+		},
+		Watch: WatchConfig{
+			Prefix:    "config-",
+			Interval:  time.Minute,
+			OrderBy:   "modtime",
+			Unarchive: true,
+		},
+		TLS: TLSConfig{
+			Cert:           "/etc/akouste/tls/tls.crt",
+			Key:            "/etc/akouste/tls/tls.key",
+			ReloadInterval: time.Minute,
+		},
+		Auth: AuthConfig{
+			TokensFile: "/etc/akouste/tokens.json",
+		},
+	}, config)
+
+	// Typos are reported instead of silently ignored
+	filename, cleanup = writeConfig(t, "storage:\n  proto: gs\n  gcs:\n    buckett: configs\n")
+	defer cleanup()
+	assert.Error(t, loadConfigFile(filename, &config))
+	assert.Error(t, loadConfigFile("/does/not/exist.yaml", &config))
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"AKOUSTE_LISTEN":                      ":9200",
+		"AKOUSTE_STORAGE_PROTO":               "local",
+		"AKOUSTE_STORAGE_LOCAL_BUCKET":        "/srv/bucket",
+		"AKOUSTE_STORAGE_GCS_ACCESS_JSON":     `{"type":"service_account"}`,
+		"AKOUSTE_STORAGE_S3_DISABLE_SSL":      "true",
+		"AKOUSTE_DOWNLOADER_DEST_PATH":        "/srv/downloads",
+		"AKOUSTE_RETENTION_KEEP_OLD_COUNT":    "3",
+		"AKOUSTE_RETENTION_MAX_TOTAL_SIZE":    "1048576",
+		"AKOUSTE_RETENTION_KEEP_WITHIN":       "24h",
+		"AKOUSTE_RETENTION_PINNED":            "config-1, config-2,",
+		"AKOUSTE_DOWNLOADER_CHECKSUM_SIDECAR": "1",
+		"AKOUSTE_HEALTH_MIN_FREE_SPACE":       "1024",
+		"AKOUSTE_HOOKS_SIGNALS":               "USR2:/var/run/app.pid",
+		"AKOUSTE_HOOKS_ROLLBACK_ON_FAILURE":   "true",
+		"AKOUSTE_WEBHOOK_SECRET_FILE":         "/etc/akouste/webhook-secret",
+		"AKOUSTE_WATCH_INTERVAL":              "30s",
+		"AKOUSTE_WATCH_UNARCHIVE":             "false",
+		"AKOUSTE_TLS_CLIENT_CA":               "/etc/akouste/tls/ca.crt",
+		"AKOUSTE_AUTH_TOKENS_FILE":            "/etc/akouste/tokens.json",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	config := defaultConfig()
+	assert.NoError(t, applyEnv(&config, lookupEnv))
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, ":9200", config.Listen)
+	assert.Equal(t, local.Config{Bucket: "/srv/bucket"}, config.Storage.Local)
+	assert.Equal(t, gcs.Config{AccessJSON: `{"type":"service_account"}`}, config.Storage.GCS)
+	assert.True(t, config.Storage.S3.DisableSSL)
+	assert.Equal(t, DownloaderConfig{DestPath: "/srv/downloads", ChecksumSidecar: true}, config.Downloader)
+	assert.Equal(t, RetentionConfig{
+		KeepOldCount: 3,
+		KeepWithin:   24 * time.Hour,
+		MaxTotalSize: 1 << 20,
+		Pinned:       []string{"config-1", "config-2"},
+	}, config.Retention)
+	assert.Equal(t, int64(1024), config.Health.MinFreeSpace)
+	assert.Equal(t, HooksConfig{
+		Signals:           []string{"USR2:/var/run/app.pid"},
+		Timeout:           time.Minute,
+		RollbackOnFailure: true,
+	}, config.Hooks)
+	assert.Equal(t, "/etc/akouste/webhook-secret", config.Webhook.SecretFile)
+	assert.Equal(t, WatchConfig{Interval: 30 * time.Second, OrderBy: "name"}, config.Watch)
+	assert.Equal(t, "/etc/akouste/tls/ca.crt", config.TLS.ClientCA)
+	assert.True(t, config.TLS.enabled())
+	assert.Equal(t, "/etc/akouste/tokens.json", config.Auth.TokensFile)
+
+	env = map[string]string{"AKOUSTE_RETENTION_KEEP_OLD_COUNT": "five"}
+	err := applyEnv(&config, lookupEnv)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "AKOUSTE_RETENTION_KEEP_OLD_COUNT")
+}
+
+func TestOverride(t *testing.T) {
+	config := defaultConfig()
+	config.Storage.Proto = "gs"
+	f := &appFlag{}
+	f.bucketName = "configs"
+	f.listen = ":9300"
+	f.pinned = arrayFlags{"config-3"}
+	f.destPath = "/srv/downloads"
+	f.hookURLs = arrayFlags{"http://127.0.0.1:8080/reload"}
+	f.watchPrefix = "config-"
+	f.tlsCert = "/etc/akouste/tls/tls.crt"
+	f.authTokensFile = "/etc/akouste/tokens.json"
+	for _, name := range []string{"bucketName", "listen", "pin", "downloadDIR", "hookURL", "watchPrefix", "tlsCert", "authTokensFile"} {
+		f.override(&config, name)
+	}
+	assert.Equal(t, "configs", config.Storage.GCS.Bucket)
+	assert.Equal(t, ":9300", config.Listen)
+	assert.Equal(t, []string{"config-3"}, config.Retention.Pinned)
+	assert.Equal(t, []string{"http://127.0.0.1:8080/reload"}, config.Hooks.URLs)
+	assert.Equal(t, "config-", config.Watch.Prefix)
+	assert.Equal(t, "/etc/akouste/tls/tls.crt", config.TLS.Cert)
+	assert.Equal(t, "/etc/akouste/tokens.json", config.Auth.TokensFile)
+	assert.NoError(t, config.Validate())
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() Config {
+		config := defaultConfig()
+		config.Storage.Proto = "local"
+		config.Storage.Local.Bucket = "/srv/bucket"
+		config.Downloader.DestPath = "/srv/downloads"
+		return config
+	}
+	assert.NoError(t, valid().Validate())
+
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		err    error
+	}{
+		{"empty listen", func(c *Config) { c.Listen = "" }, ErrEmptyListen},
+		{"zero shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, ErrInvalidShutdownTimeout},
+		{"empty dest path", func(c *Config) { c.Downloader.DestPath = "" }, ErrEmptyDestPath},
+		{"negative keep old count", func(c *Config) { c.Retention.KeepOldCount = -1 }, ErrNegativeRetention},
+		{"negative max total size", func(c *Config) { c.Retention.MaxTotalSize = -1 }, ErrNegativeRetention},
+		{"negative min free space", func(c *Config) { c.Health.MinFreeSpace = -1 }, ErrNegativeMinFreeSpace},
+		{"zero hook timeout", func(c *Config) { c.Hooks.Timeout = 0 }, ErrInvalidHookTimeout},
+	}
+	for _, test := range tests {
+		config := valid()
+		test.modify(&config)
+		assert.Equal(t, test.err, config.Validate(), test.name)
+	}
+
+	for _, proto := range []string{"", "ftp", "gs", "s3"} {
+		config := valid()
+		config.Storage.Proto = proto
+		assert.Error(t, config.Validate(), proto)
+	}
+	config := valid()
+	config.Storage.Local.Bucket = ""
+	assert.Error(t, config.Validate())
+
+	// The watch settings are only validated in watch mode
+	config = valid()
+	config.Watch.OrderBy = "size"
+	assert.NoError(t, config.Validate())
+	config.Watch.Prefix = "config-"
+	assert.Error(t, config.Validate())
+}
@@ -1,90 +1,422 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/albertwidi/akouste/downloader"
+	"github.com/albertwidi/akouste/pkg/auth"
+	"github.com/albertwidi/akouste/pkg/hook"
 	"github.com/albertwidi/akouste/pkg/log"
+	"github.com/albertwidi/akouste/pkg/signature"
 	"github.com/albertwidi/akouste/pkg/storage"
 	"github.com/albertwidi/akouste/pkg/storage/gcs"
 	"github.com/albertwidi/akouste/pkg/storage/local"
+	"github.com/albertwidi/akouste/pkg/storage/s3"
+	"github.com/albertwidi/akouste/pkg/tlsconfig"
+	"github.com/albertwidi/akouste/pkg/webhook"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+type arrayFlags []string
+
+func (af *arrayFlags) String() string {
+	return strings.Join(*af, ",")
+}
+
+func (af *arrayFlags) Set(value string) error {
+	*af = append(*af, value)
+	return nil
+}
+
 // appFlag contains app command-line flag
 type appFlag struct {
 	downloaderFlag
 	storageProviderFlag
+	watchFlag
+	tlsFlag
 
-	logLevel string
+	configFile      string
+	listen          string
+	logLevel        string
+	authTokensFile  string
+	shutdownTimeout time.Duration
 }
 
 type downloaderFlag struct {
-	keepOldCount int
-	destPath     string
+	keepOldCount    int
+	keepWithin      time.Duration
+	maxTotalSize    int64
+	pinned          arrayFlags
+	destPath        string
+	checksumSidecar bool
+	trustedKeys     arrayFlags
+
+	hookCommands          arrayFlags
+	hookSignals           arrayFlags
+	hookURLs              arrayFlags
+	hookTimeout           time.Duration
+	rollbackOnHookFailure bool
+
+	webhookURLs       arrayFlags
+	webhookSecretFile string
+
+	minFreeSpace         int64
+	requireActiveVersion bool
+}
+
+type watchFlag struct {
+	watchPrefix    string
+	watchInterval  time.Duration
+	watchOrderBy   string
+	watchUnarchive bool
+}
+
+type tlsFlag struct {
+	tlsCert           string
+	tlsKey            string
+	tlsClientCA       string
+	tlsReloadInterval time.Duration
 }
 
 type storageProviderFlag struct {
 	bucketName  string
 	bucketProto string
+
+	s3Endpoint        string
+	s3Region          string
+	s3ForcePathStyle  bool
+	s3DisableSSL      bool
+	s3CredentialsFile string
+	s3Profile         string
 }
 
 func main() {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
+	defaults := defaultConfig()
 	appFlag := &appFlag{}
-	flag.StringVar(&appFlag.logLevel, "logLevel", "info", "set the log level")
-	flag.StringVar(&appFlag.bucketProto, "bucketProto", "", "the bucket provider/protocol ('gs', 'local', etc.)")
+	flag.StringVar(&appFlag.configFile, "config", "", "path to a YAML config file, AKOUSTE_* environment variables and flags override its settings")
+	flag.StringVar(&appFlag.listen, "listen", defaults.Listen, "address the API listens on")
+	flag.StringVar(&appFlag.logLevel, "logLevel", defaults.LogLevel, "set the log level")
+	flag.DurationVar(&appFlag.shutdownTimeout, "shutdownTimeout", defaults.ShutdownTimeout, "time given to the requests and downloads in flight to finish on SIGTERM/SIGINT before they are cancelled")
+	flag.StringVar(&appFlag.authTokensFile, "authTokensFile", "", "path to a JSON file of the API tokens, the API is unauthenticated when empty")
+	flag.StringVar(&appFlag.bucketProto, "bucketProto", "", "the bucket provider/protocol ('gs', 's3' or 'local')")
 	flag.StringVar(&appFlag.bucketName, "bucketName", "", "the bucket name (dir path for 'local' bucketProto)")
+	flag.StringVar(&appFlag.s3Endpoint, "s3Endpoint", "", "endpoint of an S3 compatible service, e.g. 'http://minio:9000' or 'https://sgp1.digitaloceanspaces.com'")
+	flag.StringVar(&appFlag.s3Region, "s3Region", "", "the S3 region, 'us-east-1' when empty")
+	flag.BoolVar(&appFlag.s3ForcePathStyle, "s3ForcePathStyle", false, "address the S3 bucket in the path rather than in the host name, required by MinIO")
+	flag.BoolVar(&appFlag.s3DisableSSL, "s3DisableSSL", false, "use http rather than https when -s3Endpoint has no scheme")
+	flag.StringVar(&appFlag.s3CredentialsFile, "s3CredentialsFile", "", "path to the AWS shared credentials file, used when the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables are not set")
+	flag.StringVar(&appFlag.s3Profile, "s3Profile", "", "profile of the AWS shared credentials file, 'default' when empty")
 	flag.StringVar(&appFlag.destPath, "downloadDIR", "", "download destination")
-	flag.IntVar(&appFlag.keepOldCount, "keepOldCount", 5, "the number of downloaded versions to keep")
+	flag.IntVar(&appFlag.keepOldCount, "keepOldCount", defaults.Retention.KeepOldCount, "the number of downloaded versions to keep")
+	flag.DurationVar(&appFlag.keepWithin, "keepWithin", 0, "delete the versions downloaded longer ago than this duration (disabled when 0)")
+	flag.Int64Var(&appFlag.maxTotalSize, "maxTotalSize", 0, "delete the oldest versions until the versions take at most this number of bytes (disabled when 0)")
+	flag.Var(&appFlag.pinned, "pin", "name of a version never deleted by the retention (repeatable)")
+	flag.Var(&appFlag.trustedKeys, "trustedKey", "path to a trusted ed25519/minisign public key, artifacts must be signed when set (repeatable)")
+	flag.BoolVar(&appFlag.checksumSidecar, "checksumSidecar", false, "verify downloads against '<uri>.sha256' or '<uri>.sha512' objects in the bucket")
+	flag.Var(&appFlag.hookCommands, "hookCommand", "shell command run after a version is activated, with AKOUSTE_VERSION_DIR etc. in its environment (repeatable)")
+	flag.Var(&appFlag.hookSignals, "hookSignal", "signal sent after a version is activated, as '<signal>:<pid or pidfile>' e.g. 'USR2:/var/run/app.pid' (repeatable)")
+	flag.Var(&appFlag.hookURLs, "hookURL", "URL the activated version is posted to as JSON (repeatable)")
+	flag.DurationVar(&appFlag.hookTimeout, "hookTimeout", defaults.Hooks.Timeout, "time after which a hook command or URL is considered failed")
+	flag.BoolVar(&appFlag.rollbackOnHookFailure, "rollbackOnHookFailure", false, "re-activate the previous version when a hook fails after a download")
+	flag.Var(&appFlag.webhookURLs, "webhookURL", "URL the download, extract, prune and failure events are posted to as JSON (repeatable)")
+	flag.StringVar(&appFlag.webhookSecretFile, "webhookSecretFile", "", "path to the secret the webhook requests are HMAC-SHA256 signed with (unsigned when empty)")
+	flag.Int64Var(&appFlag.minFreeSpace, "minFreeSpace", 0, "free bytes downloadDIR must have for /v1/readyz to succeed (not checked when 0)")
+	flag.BoolVar(&appFlag.requireActiveVersion, "requireActiveVersion", false, "whether /v1/readyz fails until a version is active")
+	flag.StringVar(&appFlag.watchPrefix, "watchPrefix", "", "poll the bucket for new objects under this prefix (watch mode is enabled when set)")
+	flag.DurationVar(&appFlag.watchInterval, "watchInterval", defaults.Watch.Interval, "time between two bucket polls in watch mode")
+	flag.StringVar(&appFlag.watchOrderBy, "watchOrderBy", defaults.Watch.OrderBy, "how the newest object is picked in watch mode ('name' or 'modtime')")
+	flag.BoolVar(&appFlag.watchUnarchive, "watchUnarchive", defaults.Watch.Unarchive, "whether to unarchive the objects downloaded in watch mode")
+	flag.StringVar(&appFlag.tlsCert, "tlsCert", "", "path to the PEM certificate chain served over TLS (TLS is enabled when set)")
+	flag.StringVar(&appFlag.tlsKey, "tlsKey", "", "path to the PEM private key of -tlsCert")
+	flag.StringVar(&appFlag.tlsClientCA, "tlsClientCA", "", "path to the PEM CA certificates client certificates must be signed by (mutual TLS is enabled when set)")
+	flag.DurationVar(&appFlag.tlsReloadInterval, "tlsReloadInterval", defaults.TLS.ReloadInterval, "time between two checks of the TLS files for a new certificate")
 	flag.Parse()
 
-	log.SetLevelString(appFlag.logLevel)
+	config := defaults
+	if appFlag.configFile != "" {
+		if err := loadConfigFile(appFlag.configFile, &config); err != nil {
+			log.Fatalf("error loading config: %s", err.Error())
+		}
+	}
+	if err := applyEnv(&config, os.LookupEnv); err != nil {
+		log.Fatalf("error loading config: %s", err.Error())
+	}
+	flag.Visit(func(f *flag.Flag) {
+		appFlag.override(&config, f.Name)
+	})
+	if err := config.Validate(); err != nil {
+		log.Fatalf("invalid config: %s", err.Error())
+	}
+
+	log.SetLevelString(config.LogLevel)
 
-	storageProvider, err := newStorageProvider(ctx, appFlag.bucketProto, appFlag.bucketName)
+	storageProvider, err := newStorageProvider(ctx, config.Storage)
 	if err != nil {
 		log.Fatalf("error initializing storage provider: %s", err.Error())
 	}
 
+	trustedKeys := []signature.PublicKey{}
+	for _, filename := range config.Downloader.TrustedKeys {
+		key, err := signature.LoadPublicKeyFile(filename)
+		if err != nil {
+			log.Fatalf("error loading trusted key: %s", err.Error())
+		}
+		trustedKeys = append(trustedKeys, key)
+	}
+
+	retention := []downloader.RetentionPolicy{}
+	if config.Retention.KeepWithin > 0 {
+		retention = append(retention, downloader.KeepWithin(config.Retention.KeepWithin))
+	}
+	if config.Retention.MaxTotalSize > 0 {
+		retention = append(retention, downloader.MaxTotalSize(config.Retention.MaxTotalSize))
+	}
+
+	hooks := []hook.Hook{}
+	for _, command := range config.Hooks.Commands {
+		hooks = append(hooks, hook.NewShellCommand(command, config.Hooks.Timeout))
+	}
+	for _, spec := range config.Hooks.Signals {
+		sig, err := hook.NewSignal(spec)
+		if err != nil {
+			log.Fatalf("error initializing hook: %s", err.Error())
+		}
+		hooks = append(hooks, sig)
+	}
+	for _, url := range config.Hooks.URLs {
+		hooks = append(hooks, &hook.HTTP{URL: url, Client: &http.Client{Timeout: config.Hooks.Timeout}})
+	}
+
+	var notifier *webhook.Notifier
+	if len(config.Webhook.URLs) > 0 {
+		var secret []byte
+		if config.Webhook.SecretFile != "" {
+			content, err := ioutil.ReadFile(config.Webhook.SecretFile)
+			if err != nil {
+				log.Fatalf("error loading webhook secret: %s", err.Error())
+			}
+			secret = bytes.TrimSpace(content)
+		}
+		notifier = webhook.New(webhook.Config{
+			URLs:   config.Webhook.URLs,
+			Secret: secret,
+			Client: &http.Client{Timeout: 30 * time.Second},
+		})
+	}
+
 	downloader, err := downloader.New(ctx, storageProvider, downloader.Config{
-		DestPath:     appFlag.destPath,
-		KeepOldCount: appFlag.keepOldCount,
+		DestPath:        config.Downloader.DestPath,
+		KeepOldCount:    config.Retention.KeepOldCount,
+		Retention:       retention,
+		Pinned:          config.Retention.Pinned,
+		ChecksumSidecar: config.Downloader.ChecksumSidecar,
+		TrustedKeys:     trustedKeys,
+
+		Hooks:                 hooks,
+		RollbackOnHookFailure: config.Hooks.RollbackOnFailure,
+		Webhook:               notifier,
+
+		MinFreeSpace:         config.Health.MinFreeSpace,
+		RequireActiveVersion: config.Health.RequireActiveVersion,
 	})
 	if err != nil {
 		log.Fatalf("error initializing downloader: %s\n", err.Error())
 	}
 
+	// The watch is stopped before the downloader shuts down, so it does not poll while downloads are drained
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	if config.Watch.Prefix != "" {
+		go downloader.Watch(watchCtx, config.Watch.downloaderConfig())
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	if err := downloader.RegisterMetrics(registry); err != nil {
+		log.Fatalf("error registering metrics: %s", err.Error())
+	}
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "akouste",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by path, method and status code.",
+	}, []string{"path", "method", "code"})
+	registry.MustRegister(requests)
+
 	router := mux.NewRouter()
+	router.Methods("GET").Path("/metrics").Handler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 	handler := router.PathPrefix("/v1").Subrouter()
+	handler.Use(countRequests(requests))
 	handler.Methods("GET").Path("/ping").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("PONG\n"))
 	})
-	handler.Methods("POST").Path("/download").HandlerFunc(downloader.HandlerDownload)
+	handler.Methods("GET").Path("/healthz").HandlerFunc(downloader.HandlerHealthz)
+	handler.Methods("GET").Path("/readyz").HandlerFunc(downloader.HandlerReadyz)
+
+	var reloader *tlsconfig.Reloader
+	if config.TLS.enabled() {
+		reloader, err = tlsconfig.New(tlsconfig.Config{
+			CertFile:       config.TLS.Cert,
+			KeyFile:        config.TLS.Key,
+			ClientCAFile:   config.TLS.ClientCA,
+			ReloadInterval: config.TLS.ReloadInterval,
+		})
+		if err != nil {
+			log.Fatalf("error initializing TLS: %s", err.Error())
+		}
+		go reloader.Watch(ctx)
+	}
+
+	// Every route but metrics, ping and the health checks requires a client certificate
+	// with mutual TLS, and a token when tokens are configured
+	api := handler.NewRoute().Subrouter()
+	if reloader != nil {
+		api.Use(reloader.RequireClientCert)
+	}
+	if config.Auth.TokensFile != "" {
+		tokens, err := auth.LoadTokensFile(config.Auth.TokensFile)
+		if err != nil {
+			log.Fatalf("error loading auth tokens: %s", err.Error())
+		}
+		authenticator, err := auth.New(tokens)
+		if err != nil {
+			log.Fatalf("error initializing auth: %s", err.Error())
+		}
+		api.Use(authenticator.Middleware)
+	} else {
+		log.Warnf("no auth tokens file given, the API is unauthenticated")
+	}
+	api.Methods("POST").Path("/download").HandlerFunc(downloader.HandlerDownload)
+	api.Methods("POST").Path("/batch").HandlerFunc(downloader.HandlerBatch)
+	api.Methods("POST").Path("/sync").HandlerFunc(downloader.HandlerSync)
+	api.Methods("GET").Path("/jobs/{id}").HandlerFunc(downloader.HandlerJob)
+	api.Methods("POST").Path("/rollback").HandlerFunc(downloader.HandlerRollback)
+	api.Methods("GET").Path("/versions").HandlerFunc(downloader.HandlerVersions)
+
+	server := &http.Server{Addr: config.Listen, Handler: router}
+	serverErr := make(chan error, 1)
+	if reloader == nil {
+		go func() {
+			serverErr <- server.ListenAndServe()
+		}()
+	} else {
+		server.TLSConfig = reloader.TLSConfig()
+		go func() {
+			serverErr <- server.ListenAndServeTLS("", "")
+		}()
+	}
 
-	log.Fatal(http.ListenAndServe(":9000", handler))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Infof("received %s, shutting down", sig)
+	}
+	signal.Stop(signals)
+
+	stopWatch()
+	shutdown(config.ShutdownTimeout, server, downloader, notifier)
+}
+
+// shutdown stops accepting requests and downloads, waits for the ones in flight and
+// for the pending webhook events until timeout
+func shutdown(timeout time.Duration, server *http.Server, d *downloader.Downloader, notifier *webhook.Notifier) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Asynchronous and watch mode downloads are not requests, both are drained together
+	var wg sync.WaitGroup
+	var downloaderErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("error shutting down the server: %s", err.Error())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		downloaderErr = d.Shutdown(ctx)
+		if downloaderErr != nil {
+			log.Warnf("error shutting down the downloader: %s", downloaderErr.Error())
+		}
+	}()
+	wg.Wait()
+
+	// Downloads still in flight may notify, the notifier is only closed once they are done
+	switch {
+	case notifier == nil:
+	case downloaderErr != nil:
+		log.Warnf("downloads still in flight, webhook events not sent yet are dropped")
+	default:
+		closed := make(chan struct{})
+		go func() {
+			notifier.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-ctx.Done():
+			log.Warnf("webhook events not sent before the shutdown timeout are dropped")
+		}
+	}
+	log.Infof("shutdown complete")
+}
+
+// countRequests counts the requests by path template, method and status code,
+// rejected requests included
+func countRequests(requests *prometheus.CounterVec) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, _ := mux.CurrentRoute(r).GetPathTemplate()
+			counter := requests.MustCurryWith(prometheus.Labels{"path": path})
+			promhttp.InstrumentHandlerCounter(counter, next).ServeHTTP(w, r)
+		})
+	}
 }
 
-func newStorageProvider(ctx context.Context, bucketProto, bucketName string) (*storage.Storage, error) {
-	switch bucketProto {
+func newStorageProvider(ctx context.Context, config StorageConfig) (*storage.Storage, error) {
+	switch config.Proto {
 	case "gs":
-		gcs, err := gcs.New(ctx, gcs.Config{Bucket: bucketName})
+		gcs, err := gcs.New(ctx, config.GCS)
 		if err != nil {
 			return nil, err
 		}
 		return storage.New(gcs), nil
 
+	case "s3":
+		s3, err := s3.New(ctx, config.S3)
+		if err != nil {
+			return nil, err
+		}
+		return storage.New(s3), nil
+
 	case "local":
-		loc, err := local.New(local.Config{Bucket: bucketName})
+		loc, err := local.New(config.Local)
 		if err != nil {
 			return nil, err
 		}
 		return storage.New(loc), nil
 
 	default:
-		return nil, errors.New("unknown bucket protocol")
+		return nil, fmt.Errorf("%s: %q", ErrUnknownBucketProto.Error(), config.Proto)
 	}
 }
@@ -0,0 +1,133 @@
+package downloader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/albertwidi/akouste/pkg/archive"
+)
+
+// CurrentLink is the name of the symlink in DestPath pointing to the active version
+const CurrentLink = "current"
+
+// Prefixes of the hidden working entries in DestPath
+const (
+	stagingPrefix = ".staging-"
+	oldPrefix     = ".old-"
+	linkPrefix    = ".current-"
+	probePrefix   = ".probe-"
+)
+
+// extract unarchives source into DestPath/name.
+// The archive is extracted into a hidden staging directory first and renamed into place
+// once complete, so readers never see a partially extracted version.
+func (d *Downloader) extract(source, name string) (string, error) {
+	staging, err := ioutil.TempDir(d.config.DestPath, stagingPrefix+name+"-")
+	if err != nil {
+		return "", err
+	}
+
+	err = archive.Unarchive(source, staging)
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+
+	// TempDir creates the directory with 0700 permission
+	if err := os.Chmod(staging, 0755); err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+
+	dir := filepath.Join(d.config.DestPath, name)
+	if err := d.replaceDir(staging, dir); err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// replaceDir renames src to dst, moving an existing dst out of the way first
+func (d *Downloader) replaceDir(src, dst string) error {
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return os.Rename(src, dst)
+	}
+
+	// Reserve a unique name to move the existing version to,
+	// not every filesystem allows renaming over an empty directory
+	old, err := ioutil.TempDir(d.config.DestPath, oldPrefix+filepath.Base(dst)+"-")
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dst, old); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		// Put the previous version back
+		os.Rename(old, dst)
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+// activate atomically points the CurrentLink symlink to the version in DestPath/name
+func (d *Downloader) activate(name string) error {
+	if _, err := os.Stat(filepath.Join(d.config.DestPath, name)); err != nil {
+		return err
+	}
+
+	// Create the new link under a temporary name and rename it over the current one,
+	// rename is atomic so the link always points to a complete version
+	tmp, err := ioutil.TempFile(d.config.DestPath, linkPrefix)
+	if err != nil {
+		return err
+	}
+	tmpLink := tmp.Name()
+	tmp.Close()
+	if err := os.Remove(tmpLink); err != nil {
+		return err
+	}
+
+	// The target is relative so DestPath can be mounted anywhere
+	if err := os.Symlink(name, tmpLink); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpLink, filepath.Join(d.config.DestPath, CurrentLink)); err != nil {
+		os.Remove(tmpLink)
+		return err
+	}
+
+	return nil
+}
+
+// activeVersion returns the name of the version CurrentLink points to,
+// or an empty string when there is no active version
+func (d *Downloader) activeVersion() (string, error) {
+	target, err := os.Readlink(filepath.Join(d.config.DestPath, CurrentLink))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(target)
+	if strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid %s link target: %s", CurrentLink, target)
+	}
+	return name, nil
+}
+
+// isVersionEntry returns false for the entries in DestPath which are not downloaded versions,
+// i.e. CurrentLink and hidden working files
+func isVersionEntry(name string) bool {
+	return name != "" && name != CurrentLink && !strings.HasPrefix(name, ".")
+}
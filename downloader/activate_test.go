@@ -0,0 +1,58 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// copyFixture copies a file from the test local bucket into bucket
+func copyFixture(t *testing.T, bucket, name string) {
+	content, err := ioutil.ReadFile(filepath.Join("..", "test", "local-bucket", name))
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(bucket, name), content, 0644)
+	assert.NoError(t, err)
+}
+
+func TestHandlerDownloadActivate(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	current := filepath.Join(d.config.DestPath, CurrentLink)
+	target, err := os.Readlink(current)
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", target)
+	assert.FileExists(t, filepath.Join(current, "test1.yaml"))
+
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-2.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-2", active)
+
+	// Re-extracting an existing version replaces it
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	active, err = d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", active)
+
+	// No staging leftovers or downloaded archives
+	entries, err := ioutil.ReadDir(d.config.DestPath)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{StateDir, "config-1", "config-2", CurrentLink}, names)
+}
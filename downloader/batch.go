@@ -0,0 +1,356 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/archive"
+	"github.com/albertwidi/akouste/pkg/log"
+	"github.com/albertwidi/akouste/pkg/storage"
+	"github.com/albertwidi/akouste/pkg/webhook"
+)
+
+// Error variables
+var (
+	ErrEmptyBatch    = errors.New("empty batch")
+	ErrBatchTooLarge = errors.New("too many batch items")
+	ErrBatchConflict = errors.New("conflicting batch items")
+)
+
+// maxBatchItems limits the number of items of a batch
+const maxBatchItems = 100
+
+// batchPrefix prefixes the default name of batch versions
+const batchPrefix = "batch-"
+
+// batchBody holds the fields of a JSON batch request
+type batchBody struct {
+	Items   []batchItemBody `json:"items"`
+	Version string          `json:"version"`
+	Async   bool            `json:"async"`
+}
+
+type batchItemBody struct {
+	URI       string `json:"uri"`
+	Unarchive bool   `json:"unarchive"`
+	checksumFields
+}
+
+// batchRequest contains the parameters of a batch download
+type batchRequest struct {
+	// Name of the version in DestPath
+	Name  string
+	Items []downloadRequest
+}
+
+// entry returns the name of the entry of item in the batch version directory
+func (item downloadRequest) entry() string {
+	if item.Unarchive {
+		return folderNameFromFileName(item.URI)
+	}
+	return filepath.Base(item.URI)
+}
+
+// HandlerBatch downloads several objects and activates them together as a single version.
+// Either every item is fetched, verified and activated, or none is.
+// Accepted JSON body fields:
+// - items   : objects to download, each with a uri, and optional unarchive, sha256 and sha512 fields
+// - version : name of the version in DestPath (optional, defaults to batch-<hash of the items>)
+// - async   : whether to run the download in the background (true/false)
+//
+// The version is a directory holding the items, archives are extracted into a directory
+// named after the archive and other files are stored under their name.
+//
+// e.g. curl -X POST -H "Content-Type: application/json" -d '{"items":[{"uri":"base.tar.gz","unarchive":true},{"uri":"flags.json"}]}' localhost:9000/v1/batch
+func (d *Downloader) HandlerBatch(w http.ResponseWriter, r *http.Request) {
+	// Batches are only JSON encoded, the uris of their items are authorized from the JSON body
+	if !isJSON(r) {
+		writeRequestError(w, r, http.StatusUnsupportedMediaType, CodeInvalidRequest, errors.New("batch requests must be application/json"))
+		return
+	}
+	var body batchBody
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&body); err != nil {
+		writeRequestError(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("parse json failed: %s", err.Error()))
+		return
+	}
+
+	req, code, err := newBatchRequest(body)
+	if err != nil {
+		writeRequestError(w, r, http.StatusBadRequest, code, err)
+		return
+	}
+
+	if err := d.accepting(); err != nil {
+		writeDownloadError(w, r, err)
+		return
+	}
+
+	job := newJob(req.uri())
+	if body.Async {
+		d.jobs.add(job)
+		go d.downloadBatch(context.Background(), req, job)
+
+		w.Header().Set("Location", path.Join(r.URL.Path, "..", "jobs", job.ID))
+		writeJSON(w, http.StatusAccepted, job.snapshot())
+		return
+	}
+
+	result, err := d.downloadBatch(context.Background(), req, job)
+	if err != nil {
+		writeDownloadError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// newBatchRequest validates body, it returns the error code of invalid requests
+func newBatchRequest(body batchBody) (batchRequest, string, error) {
+	if len(body.Items) == 0 {
+		return batchRequest{}, CodeInvalidRequest, ErrEmptyBatch
+	}
+	if len(body.Items) > maxBatchItems {
+		return batchRequest{}, CodeInvalidRequest, fmt.Errorf("%s: %d > %d", ErrBatchTooLarge.Error(), len(body.Items), maxBatchItems)
+	}
+
+	req := batchRequest{Name: body.Version}
+	entries := map[string]string{}
+	for _, item := range body.Items {
+		if item.URI == "" {
+			return batchRequest{}, CodeInvalidRequest, errors.New("empty uri field")
+		}
+		if err := validateURI(item.URI); err != nil {
+			return batchRequest{}, CodeInvalidURI, err
+		}
+		expected, err := item.parseChecksum()
+		if err != nil {
+			return batchRequest{}, CodeInvalidChecksum, err
+		}
+
+		// Items are fetched to their base name and stored to their entry in the version
+		itemReq := downloadRequest{URI: item.URI, Unarchive: item.Unarchive, Checksum: expected}
+		for _, name := range []string{filepath.Base(item.URI), itemReq.entry()} {
+			other, ok := entries[name]
+			if ok && other == item.URI {
+				return batchRequest{}, CodeInvalidRequest, fmt.Errorf("%s: duplicate %s", ErrBatchConflict.Error(), item.URI)
+			}
+			if ok {
+				return batchRequest{}, CodeInvalidRequest, fmt.Errorf("%s: %s and %s both use %q", ErrBatchConflict.Error(), other, item.URI, name)
+			}
+		}
+		entries[filepath.Base(item.URI)] = item.URI
+		entries[itemReq.entry()] = item.URI
+		req.Items = append(req.Items, itemReq)
+	}
+
+	if req.Name == "" {
+		req.Name = req.defaultName()
+	}
+	if err := validateVersionName(req.Name); err != nil {
+		return batchRequest{}, CodeInvalidVersion, err
+	}
+	return req, "", nil
+}
+
+// defaultName names the version after the items, identical batches get the same version
+func (r batchRequest) defaultName() string {
+	h := sha256.New()
+	for _, item := range r.Items {
+		expected := ""
+		if item.Checksum != nil {
+			expected = item.Checksum.Algorithm + ":" + item.Checksum.Value
+		}
+		fmt.Fprintf(h, "%s\x00%t\x00%s\x00", item.URI, item.Unarchive, expected)
+	}
+	return batchPrefix + hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// uri identifies the batch in jobs, results and events by the comma separated uris of its items
+func (r batchRequest) uri() string {
+	uris := make([]string, 0, len(r.Items))
+	for _, item := range r.Items {
+		uris = append(uris, item.URI)
+	}
+	return strings.Join(uris, ",")
+}
+
+// downloadBatch fetches the items of req and activates them as a single version, reporting
+// its progress to job
+func (d *Downloader) downloadBatch(ctx context.Context, req batchRequest, job *Job) (result *DownloadResult, err error) {
+	defer func() {
+		job.finish(result, err)
+	}()
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	keys := []string{req.Name}
+	for _, item := range req.Items {
+		keys = append(keys, filepath.Base(item.URI))
+	}
+	unlock := d.destinations.lockAll(keys...)
+	defer unlock()
+
+	start := time.Now()
+	result, err = d.runBatch(ctx, req, job)
+	if err != nil {
+		d.metrics.downloads.WithLabelValues(resultFailure).Inc()
+		d.notifyFailure(req.uri(), result, start, err)
+		return result, err
+	}
+	d.metrics.downloads.WithLabelValues(resultSuccess).Inc()
+	return result, nil
+}
+
+// runBatch downloads the items of req into a staging directory and installs it,
+// the destinations of req must be locked
+func (d *Downloader) runBatch(ctx context.Context, req batchRequest, job *Job) (*DownloadResult, error) {
+	if err := d.checkNotSynced(req.Name); err != nil {
+		return nil, err
+	}
+	// Every object is checked before anything is downloaded
+	objects := make([]storage.Object, len(req.Items))
+	for i := range req.Items {
+		object, err := d.attributes(ctx, &req.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		objects[i] = object
+	}
+
+	staging, err := ioutil.TempDir(d.config.DestPath, stagingPrefix+req.Name+"-")
+	if err != nil {
+		return nil, &downloadError{
+			status: http.StatusInternalServerError,
+			code:   CodeInternal,
+			err:    fmt.Errorf("write file error: %s", err.Error()),
+		}
+	}
+	// Nothing is left once the staging directory is renamed into place
+	defer os.RemoveAll(staging)
+
+	job.setStatus(JobDownloading)
+	version := &Version{
+		Name:     req.Name,
+		Provider: d.storage.Name(),
+		Bucket:   d.storage.BucketName(),
+	}
+	dir := filepath.Join(d.config.DestPath, req.Name)
+	result := &DownloadResult{URI: req.uri(), Version: req.Name, Path: dir, Dir: dir}
+	for i, item := range req.Items {
+		// Archives are fetched to hidden files, removed once extracted
+		file := filepath.Join(staging, filepath.Base(item.URI))
+		if item.Unarchive {
+			file = filepath.Join(staging, "."+filepath.Base(item.URI))
+		}
+		start := time.Now()
+		fetched, err := d.fetch(ctx, item, objects[i], file, job)
+		if err != nil {
+			return nil, err
+		}
+		d.notify(webhook.Event{
+			Type:     webhook.EventDownload,
+			URI:      item.URI,
+			Version:  req.Name,
+			Dir:      file,
+			Checksum: fetched.Checksum,
+			Duration: time.Since(start),
+		})
+
+		itemResult := DownloadResult{
+			URI:      item.URI,
+			Version:  req.Name,
+			Path:     filepath.Join(dir, filepath.Base(item.URI)),
+			Bytes:    fetched.Size,
+			Checksum: fetched.Checksum,
+		}
+		if item.Unarchive {
+			itemResult.Dir = filepath.Join(dir, item.entry())
+		}
+		result.Items = append(result.Items, itemResult)
+		result.Bytes += fetched.Size
+		version.Size += fetched.Size
+		version.Items = append(version.Items, item.URI)
+	}
+
+	job.setStatus(JobExtracting)
+	start := time.Now()
+	if err := d.installBatch(staging, req, version); err != nil {
+		return nil, err
+	}
+	d.notify(webhook.Event{
+		Type:     webhook.EventExtract,
+		URI:      req.uri(),
+		Version:  req.Name,
+		Dir:      dir,
+		Duration: time.Since(start),
+	})
+	defer d.prune()
+
+	// Hooks run once the version is active, without blocking the pruning
+	if err := d.activated(ctx, result); err != nil {
+		return result, err
+	}
+
+	log.Debugf("batch %s download success", req.Name)
+	return result, nil
+}
+
+// installBatch extracts the archives of req fetched into staging, moves staging to DestPath,
+// records and activates its version
+func (d *Downloader) installBatch(staging string, req batchRequest, version *Version) error {
+	// Pruning waits until the version is extracted and activated
+	d.extractMu.RLock()
+	defer d.extractMu.RUnlock()
+
+	for _, item := range req.Items {
+		if !item.Unarchive {
+			continue
+		}
+		archiveFile := filepath.Join(staging, "."+filepath.Base(item.URI))
+		dir := filepath.Join(staging, item.entry())
+		start := time.Now()
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			err = archive.Unarchive(archiveFile, dir)
+		}
+		if err != nil {
+			log.Warnf("error unarchive %s: %s", item.URI, err.Error())
+			return unarchiveError(err)
+		}
+		d.metrics.unarchiveDuration.Observe(time.Since(start).Seconds())
+		if err := os.Remove(archiveFile); err != nil {
+			log.Warnf("error delete: %s", err.Error())
+		}
+	}
+
+	// TempDir creates the directory with 0700 permission
+	err := os.Chmod(staging, 0755)
+	if err == nil {
+		err = d.replaceDir(staging, filepath.Join(d.config.DestPath, req.Name))
+	}
+	if err != nil {
+		return &downloadError{
+			status: http.StatusInternalServerError,
+			code:   CodeInternal,
+			err:    fmt.Errorf("write file error: %s", err.Error()),
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.activateNew(version)
+}
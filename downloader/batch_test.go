@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerBatch(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(bucket, "flags.json"), []byte(`{"beta":true}`), 0644))
+	sum := sha256.Sum256([]byte(`{"beta":true}`))
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = postJSON(d.HandlerBatch, `{"version":"release-1","items":[
+		{"uri":"config-2.tar.gz","unarchive":true},
+		{"uri":"flags.json","sha256":"`+hex.EncodeToString(sum[:])+`"}]}`)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var result DownloadResult
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	dir := filepath.Join(d.config.DestPath, "release-1")
+	assert.Equal(t, "release-1", result.Version)
+	assert.Equal(t, dir, result.Dir)
+	assert.Equal(t, "config-2.tar.gz,flags.json", result.URI)
+	if assert.Len(t, result.Items, 2) {
+		assert.Equal(t, filepath.Join(dir, "config-2"), result.Items[0].Dir)
+		assert.Equal(t, filepath.Join(dir, "flags.json"), result.Items[1].Path)
+		assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), result.Items[1].Checksum)
+	}
+
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "release-1", active)
+	current := filepath.Join(d.config.DestPath, CurrentLink)
+	assert.FileExists(t, filepath.Join(current, "config-2", "test1.yaml"))
+	content, err := ioutil.ReadFile(filepath.Join(current, "flags.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"beta":true}`, string(content))
+
+	// Neither the archive nor the staging directory is left behind
+	entries, err := ioutil.ReadDir(d.config.DestPath)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{StateDir, "config-1", CurrentLink, "release-1"}, names)
+	entries, err = ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	versions, err := d.Versions()
+	assert.NoError(t, err)
+	assert.Equal(t, "release-1", versions[0].Name)
+	assert.Equal(t, []string{"config-2.tar.gz", "flags.json"}, versions[0].Items)
+
+	// Batches roll back like any other version
+	version, err := d.Rollback("")
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", version)
+}
+
+func TestHandlerBatchFailure(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(bucket, "flags.json"), []byte(`{"beta":true}`), 0644))
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{
+			"checksum mismatch",
+			`{"items":[{"uri":"config-2.tar.gz","unarchive":true},{"uri":"flags.json","sha256":"` + strings.Repeat("0", 64) + `"}]}`,
+			http.StatusUnprocessableEntity, CodeChecksumMismatch,
+		},
+		{
+			"missing object",
+			`{"items":[{"uri":"config-2.tar.gz","unarchive":true},{"uri":"missing.json"}]}`,
+			http.StatusBadRequest, CodeDownloadFailed,
+		},
+		{
+			"not an archive",
+			`{"items":[{"uri":"config-2.tar.gz","unarchive":true},{"uri":"flags.json","unarchive":true}]}`,
+			http.StatusUnprocessableEntity, CodeUnsupportedArchive,
+		},
+	}
+	for _, test := range tests {
+		rr := postJSON(d.HandlerBatch, test.body)
+		assert.Equal(t, test.status, rr.Code, test.name)
+		assert.Equal(t, test.code, decodeError(t, rr).Code, test.name)
+
+		// Nothing was activated and nothing is left behind
+		active, err := d.activeVersion()
+		assert.NoError(t, err)
+		assert.Equal(t, "config-1", active, test.name)
+		entries, err := ioutil.ReadDir(d.config.DestPath)
+		assert.NoError(t, err)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		assert.Equal(t, []string{StateDir, "config-1", CurrentLink}, names, test.name)
+	}
+}
+
+func TestHandlerBatchInvalid(t *testing.T) {
+	d, _, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		body string
+		code string
+	}{
+		{"empty", `{"items":[]}`, CodeInvalidRequest},
+		{"empty uri", `{"items":[{"uri":""}]}`, CodeInvalidRequest},
+		{"invalid uri", `{"items":[{"uri":"dir/"}]}`, CodeInvalidURI},
+		{"invalid checksum", `{"items":[{"uri":"flags.json","sha256":"zz"}]}`, CodeInvalidChecksum},
+		{"duplicate", `{"items":[{"uri":"flags.json"},{"uri":"flags.json"}]}`, CodeInvalidRequest},
+		{"same name", `{"items":[{"uri":"a/flags.json"},{"uri":"b/flags.json"}]}`, CodeInvalidRequest},
+		{"same entry", `{"items":[{"uri":"config-1.tar.gz","unarchive":true},{"uri":"a/config-1"}]}`, CodeInvalidRequest},
+		{"invalid version", `{"version":".staging","items":[{"uri":"flags.json"}]}`, CodeInvalidVersion},
+	}
+	for _, test := range tests {
+		rr := postJSON(d.HandlerBatch, test.body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, test.name)
+		assert.Equal(t, test.code, decodeError(t, rr).Code, test.name)
+	}
+
+	rr := postForm(d.HandlerBatch, url.Values{"uri": {"flags.json"}})
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+}
+
+func TestHandlerBatchAsync(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+
+	body := `{"async":true,"items":[{"uri":"config-1.tar.gz","unarchive":true},{"uri":"config-2.tar.gz","unarchive":true}]}`
+	rr := postJSON(d.HandlerBatch, body)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var accepted Job
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &accepted))
+	assert.Equal(t, "config-1.tar.gz,config-2.tar.gz", accepted.URI)
+
+	var job *Job
+	for i := 0; i < 50; i++ {
+		found, ok := d.jobs.get(accepted.ID)
+		assert.True(t, ok)
+		job = found.snapshot()
+		if job.Status == JobDone || job.Status == JobFailed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, JobDone, job.Status, job.Error)
+
+	// Identical batches get the same default version
+	req, _, err := newBatchRequest(batchBody{Items: []batchItemBody{
+		{URI: "config-1.tar.gz", Unarchive: true},
+		{URI: "config-2.tar.gz", Unarchive: true},
+	}})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(req.Name, batchPrefix))
+	assert.Equal(t, req.Name, job.Result.Version)
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, req.Name, active)
+}
@@ -0,0 +1,126 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/albertwidi/akouste/pkg/storage"
+)
+
+// Error variables
+var (
+	ErrChecksumMismatch       = errors.New("checksum mismatch")
+	ErrInvalidChecksum        = errors.New("invalid checksum")
+	ErrUnsupportedChecksumAlg = errors.New("unsupported checksum algorithm")
+)
+
+// List of supported checksum algorithms
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA512 = "sha512"
+)
+
+// checksumAlgorithms is the order in which sidecar checksum objects are looked up
+var checksumAlgorithms = []string{ChecksumSHA512, ChecksumSHA256}
+
+// maxSidecarSize limits how much of a sidecar checksum object is read
+const maxSidecarSize = 4096
+
+// checksum is an expected digest of a downloaded file
+type checksum struct {
+	Algorithm string
+	Value     string
+}
+
+// newChecksum validates and returns a checksum of the given algorithm,
+// value must be hex encoded
+func newChecksum(algorithm, value string) (*checksum, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	value = strings.ToLower(strings.TrimSpace(value))
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != h.Size() {
+		return nil, fmt.Errorf("%s: %s value %q", ErrInvalidChecksum.Error(), algorithm, value)
+	}
+
+	return &checksum{
+		Algorithm: algorithm,
+		Value:     value,
+	}, nil
+}
+
+// verify compares the expected checksum with the digest computed by h
+func (c *checksum) verify(h hash.Hash) error {
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != c.Value {
+		return &ChecksumMismatchError{
+			Algorithm: c.Algorithm,
+			Expected:  c.Value,
+			Actual:    actual,
+		}
+	}
+	return nil
+}
+
+// ChecksumMismatchError is returned when the downloaded file does not match the expected checksum
+type ChecksumMismatchError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s: expected %s %s, got %s", ErrChecksumMismatch.Error(), e.Algorithm, e.Expected, e.Actual)
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumSHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("%s: %s", ErrUnsupportedChecksumAlg.Error(), algorithm)
+	}
+}
+
+// sidecarChecksum looks for a checksum object next to key in the bucket,
+// e.g. config-1.tar.gz.sha256, and returns nil when there is none.
+// The sidecar may contain the hex digest alone or the output of sha256sum/sha512sum.
+func sidecarChecksum(ctx context.Context, s *storage.Storage, key string) (*checksum, error) {
+	for _, algorithm := range checksumAlgorithms {
+		sidecar := key + "." + algorithm
+		reader, err := s.Download(ctx, sidecar)
+		if storage.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error downloading %s: %s", sidecar, err.Error())
+		}
+
+		content, err := ioutil.ReadAll(io.LimitReader(reader, maxSidecarSize))
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %s", sidecar, err.Error())
+		}
+
+		fields := strings.Fields(string(content))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%s: %s is empty", ErrInvalidChecksum.Error(), sidecar)
+		}
+		return newChecksum(algorithm, fields[0])
+	}
+
+	return nil, nil
+}
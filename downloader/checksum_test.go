@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestNewChecksum(t *testing.T) {
+	_, err := newChecksum(ChecksumSHA256, sha256Hex("hello"))
+	assert.NoError(t, err)
+
+	_, err = newChecksum(ChecksumSHA256, "not-hex")
+	assert.Error(t, err)
+
+	_, err = newChecksum(ChecksumSHA512, sha256Hex("hello"))
+	assert.Error(t, err)
+
+	_, err = newChecksum("md5", "d41d8cd98f00b204e9800998ecf8427e")
+	assert.Error(t, err)
+}
+
+func TestHandlerDownloadChecksum(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+
+	testfile := "config.txt"
+	testcontent := "hello"
+	err := ioutil.WriteFile(filepath.Join(bucket, testfile), []byte(testcontent), 0644)
+	assert.NoError(t, err)
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {testfile}, "sha256": {sha256Hex(testcontent)}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.FileExists(t, filepath.Join(d.config.DestPath, testfile))
+
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {testfile}, "sha256": {sha256Hex("corrupted")}})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrChecksumMismatch.Error())
+	// The mismatched download is removed and the verified file is left untouched
+	_, err = os.Stat(filepath.Join(d.config.DestPath, "."+testfile+partialExtension))
+	assert.True(t, os.IsNotExist(err), "mismatched file must be removed")
+	content, err := ioutil.ReadFile(filepath.Join(d.config.DestPath, testfile))
+	assert.NoError(t, err)
+	assert.Equal(t, testcontent, string(content))
+
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {testfile}, "sha256": {"invalid"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestHandlerDownloadChecksumSidecar(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2, ChecksumSidecar: true})
+	defer cleanup()
+
+	testfile := "config.txt"
+	testcontent := "hello"
+	err := ioutil.WriteFile(filepath.Join(bucket, testfile), []byte(testcontent), 0644)
+	assert.NoError(t, err)
+
+	// No sidecar, download is not verified
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {testfile}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// sha256sum formatted sidecar
+	sidecar := sha256Hex(testcontent) + "  " + testfile + "\n"
+	err = ioutil.WriteFile(filepath.Join(bucket, testfile+".sha256"), []byte(sidecar), 0644)
+	assert.NoError(t, err)
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {testfile}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	err = ioutil.WriteFile(filepath.Join(bucket, testfile+".sha256"), []byte(sha256Hex("corrupted")), 0644)
+	assert.NoError(t, err)
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {testfile}})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.True(t, strings.HasPrefix(rr.Body.String(), ErrChecksumMismatch.Error()))
+}
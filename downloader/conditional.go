@@ -0,0 +1,101 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/albertwidi/akouste/pkg/storage"
+)
+
+// source is the bucket object a version was downloaded from
+type source struct {
+	Object  storage.Object `json:"object"`
+	Version string         `json:"version"`
+}
+
+// sameObject returns true when current has the attributes recorded for the last download.
+// The MD5 is compared when both objects have one, the modification time otherwise.
+// gocloud blob does not expose ETags.
+func sameObject(recorded, current storage.Object) bool {
+	if recorded.Size != current.Size {
+		return false
+	}
+	if len(recorded.MD5) > 0 && len(current.MD5) > 0 {
+		return bytes.Equal(recorded.MD5, current.MD5)
+	}
+	return !recorded.ModTime.IsZero() && recorded.ModTime.Equal(current.ModTime)
+}
+
+// notModified returns the result of the last download of req.URI when object did not change
+// since then and its version is still retained, nil when the object must be downloaded
+func (d *Downloader) notModified(req downloadRequest, object storage.Object) *DownloadResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	src, ok := d.sources[req.URI]
+	if !ok || !sameObject(src.Object, object) {
+		return nil
+	}
+
+	base := filepath.Base(req.URI)
+	name := base
+	if req.Unarchive {
+		name = folderNameFromFileName(base)
+	}
+	version, ok := d.versions[name]
+	if !ok || src.Version != name {
+		return nil
+	}
+
+	// The version may have been deleted by the retention since
+	info, err := os.Stat(filepath.Join(d.config.DestPath, name))
+	if err != nil || info.IsDir() != req.Unarchive {
+		return nil
+	}
+
+	// A checksum given in the request must match the one of the retained version
+	if req.Checksum != nil && version.Checksum != req.Checksum.Algorithm+":"+req.Checksum.Value {
+		return nil
+	}
+
+	result := &DownloadResult{
+		URI:         req.URI,
+		Version:     name,
+		Path:        filepath.Join(d.config.DestPath, base),
+		Checksum:    version.Checksum,
+		NotModified: true,
+	}
+	if req.Unarchive {
+		result.Dir = filepath.Join(d.config.DestPath, name)
+	}
+	return result
+}
+
+// activateNotModified activates the retained version of an unchanged archive
+// when another version is active, e.g. after a rollback. It returns true if it was activated.
+func (d *Downloader) activateNotModified(result *DownloadResult) (bool, error) {
+	if result.Dir == "" {
+		return false, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	active, err := d.activeVersion()
+	if err != nil || active == result.Version {
+		return false, err
+	}
+	if err := d.activate(result.Version); err != nil {
+		return false, &downloadError{
+			status: http.StatusInternalServerError,
+			code:   CodeInternal,
+			err:    fmt.Errorf("error activate: %s", err.Error()),
+		}
+	}
+	d.history = append(d.history, result.Version)
+	d.persist()
+	return true, nil
+}
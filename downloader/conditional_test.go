@@ -0,0 +1,107 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameObject(t *testing.T) {
+	now := time.Now()
+	recorded := storage.Object{Size: 5, ModTime: now, MD5: []byte{1, 2, 3}}
+
+	assert.True(t, sameObject(recorded, storage.Object{Size: 5, ModTime: now.Add(time.Hour), MD5: []byte{1, 2, 3}}))
+	assert.False(t, sameObject(recorded, storage.Object{Size: 5, ModTime: now, MD5: []byte{3, 2, 1}}))
+	assert.False(t, sameObject(recorded, storage.Object{Size: 6, ModTime: now, MD5: []byte{1, 2, 3}}))
+
+	// Without MD5 the modification time is compared
+	assert.True(t, sameObject(storage.Object{Size: 5, ModTime: now}, storage.Object{Size: 5, ModTime: now}))
+	assert.False(t, sameObject(storage.Object{Size: 5, ModTime: now}, storage.Object{Size: 5, ModTime: now.Add(time.Second)}))
+	assert.False(t, sameObject(storage.Object{Size: 5}, storage.Object{Size: 5}))
+}
+
+func TestHandlerDownloadNotModified(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	object := filepath.Join(bucket, "testfile.txt")
+	downloaded := filepath.Join(d.config.DestPath, "testfile.txt")
+	err := ioutil.WriteFile(object, []byte("hello"), 0644)
+	assert.NoError(t, err)
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"testfile.txt"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "download success\n", rr.Body.String())
+
+	// Local edits show whether the file was downloaded again
+	err = ioutil.WriteFile(downloaded, []byte("local"), 0644)
+	assert.NoError(t, err)
+
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"testfile.txt"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "not modified\n", rr.Body.String())
+	content, err := ioutil.ReadFile(downloaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "local", string(content))
+
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"testfile.txt"}, "force": {"true"}})
+	assert.Equal(t, "download success\n", rr.Body.String())
+	content, err = ioutil.ReadFile(downloaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	// A changed object is downloaded again
+	err = ioutil.WriteFile(object, []byte("hello, world"), 0644)
+	assert.NoError(t, err)
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"testfile.txt"}})
+	assert.Equal(t, "download success\n", rr.Body.String())
+	content, err = ioutil.ReadFile(downloaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", string(content))
+}
+
+func TestHandlerDownloadNotModifiedUnarchive(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	form := url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}}
+
+	rr := postForm(d.HandlerDownload, form)
+	assert.Equal(t, "download success\n", rr.Body.String())
+	rr = postForm(d.HandlerDownload, form)
+	assert.Equal(t, "not modified\n", rr.Body.String())
+
+	// Downloading the archive without unarchiving it is another version
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}})
+	assert.Equal(t, "download success\n", rr.Body.String())
+
+	// A deleted version is downloaded again
+	assert.NoError(t, os.RemoveAll(filepath.Join(d.config.DestPath, "config-1")))
+	rr = postForm(d.HandlerDownload, form)
+	assert.Equal(t, "download success\n", rr.Body.String())
+	assert.FileExists(t, filepath.Join(d.config.DestPath, "config-1", "test1.yaml"))
+}
+
+func TestHandlerDownloadNotModifiedActivates(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+
+	for _, uri := range []string{"config-1.tar.gz", "config-2.tar.gz"} {
+		rr := postForm(d.HandlerDownload, url.Values{"uri": {uri}, "unarchive": {"true"}})
+		assert.Equal(t, "download success\n", rr.Body.String())
+	}
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, "not modified\n", rr.Body.String())
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", active)
+}
@@ -2,21 +2,44 @@ package downloader
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
 	"github.com/albertwidi/akouste/pkg/archive"
+	"github.com/albertwidi/akouste/pkg/hook"
 	"github.com/albertwidi/akouste/pkg/log"
+	"github.com/albertwidi/akouste/pkg/signature"
 	"github.com/albertwidi/akouste/pkg/storage"
+	"github.com/albertwidi/akouste/pkg/webhook"
 )
 
+// Error variables
+var (
+	ErrInvalidURI       = errors.New("invalid uri")
+	ErrSignatureMissing = errors.New("signature missing")
+)
+
+// partialExtension is appended to the hidden files being downloaded
+const partialExtension = ".partial"
+
+// maxSignatureSize limits how much of a signature object is read
+const maxSignatureSize = 4096
+
+// maxRequestSize limits how much of a JSON request body is read
+const maxRequestSize = 1 << 20
+
 // Config struct for downloader package
 type Config struct {
 	// Where to store downloads
@@ -24,12 +47,78 @@ type Config struct {
 
 	// Number of downloads to keep
 	KeepOldCount int
+
+	// Additional retention policies, a version is deleted when any policy expires it
+	Retention []RetentionPolicy
+
+	// Versions never deleted by the retention
+	Pinned []string
+
+	// Look for a checksum sidecar object (e.g. <uri>.sha256) in the bucket
+	// when no checksum is given in the request
+	ChecksumSidecar bool
+
+	// Public keys trusted to sign artifacts, when set every artifact must have
+	// a valid detached signature object (e.g. <uri>.sig) in the bucket
+	TrustedKeys []signature.PublicKey
+
+	// Hooks run after a version is activated, by a download or a rollback
+	Hooks []hook.Hook
+
+	// Re-activate the previous version when a hook fails after a download
+	RollbackOnHookFailure bool
+
+	// Notifier of the download, extract, prune and failure events, disabled when nil
+	Webhook *webhook.Notifier
+
+	// Free space in bytes DestPath must have for the downloader to be ready, not checked when 0
+	MinFreeSpace int64
+
+	// Whether the downloader is only ready once a version is active
+	RequireActiveVersion bool
 }
 
 // Downloader contains necessary downloader dependencies
 type Downloader struct {
-	config  Config
-	storage *storage.Storage
+	config   Config
+	storage  *storage.Storage
+	jobs     *jobStore
+	verifier *signature.Verifier
+	metrics  *metrics
+
+	// Serializes downloads per destination in DestPath
+	destinations keyedMutex
+	// Identical download requests in flight
+	flights flightGroup
+	// Serializes syncs per directory in DestPath, the directory is also locked
+	// in destinations while it is written to
+	syncing keyedMutex
+	// extractMu is held for reading while a version is extracted and activated,
+	// and for writing while old versions are pruned
+	extractMu sync.RWMutex
+
+	// Downloads in flight, drained by Shutdown
+	inflight sync.WaitGroup
+	// stopping is closed when Shutdown cancels the downloads in flight
+	stopping chan struct{}
+	stopOnce sync.Once
+	// closeMu guards closed, set once Shutdown is called
+	closeMu sync.Mutex
+	closed  bool
+
+	// mu guards version activation, history, versions, sources, partials, syncs and the state file
+	mu sync.Mutex
+	// Activated versions, from the oldest to the current one
+	history []string
+	// Records of the versions downloaded by this downloader, by name
+	versions map[string]*Version
+	// Objects the versions were downloaded from, by uri
+	sources map[string]source
+	// Objects of the interrupted downloads which can be resumed, by partial file,
+	// created on the first interruption
+	partials map[string]storage.Object
+	// Directories of DestPath mirroring a bucket prefix, by name
+	syncs map[string]*syncRecord
 }
 
 // New returns initialized downloader client
@@ -41,139 +130,583 @@ func New(ctx context.Context, storage *storage.Storage, config Config) (*Downloa
 		}
 	}
 
-	return &Downloader{
-		config:  config,
-		storage: storage,
-	}, nil
+	d := &Downloader{
+		config:   config,
+		storage:  storage,
+		jobs:     newJobStore(),
+		metrics:  newMetrics(),
+		stopping: make(chan struct{}),
+		versions: make(map[string]*Version),
+		sources:  make(map[string]source),
+		syncs:    make(map[string]*syncRecord),
+	}
+	if len(config.TrustedKeys) > 0 {
+		d.verifier = signature.NewVerifier(config.TrustedKeys)
+	}
+
+	if err := d.loadState(); err != nil {
+		return nil, err
+	}
+	// Remove what an interrupted run left, recorded partial files are kept to be resumed
+	d.cleanup()
+
+	return d, nil
 }
 
 // HandlerDownload handles downloads and optionally decompresses the specified archive
-// Accepted POST form fields:
+// Accepted POST form fields, or JSON body fields when Content-Type is application/json:
 // - uri       : filepath in the bucket
 // - unarchive : whether to unarchive downloaded file (true/false)
+// - async     : whether to run the download in the background (true/false)
+// - force     : whether to download the object even when it did not change (true/false)
+// - sha256    : expected hex encoded sha256 checksum of the file (optional)
+// - sha512    : expected hex encoded sha512 checksum of the file (optional)
+//
+// When async is true the handler responds with 202 Accepted and a job ID,
+// the job status can then be polled from HandlerJob.
+//
+// The object is not downloaded again when its MD5, or size and modification time, did not
+// change since the last download of the same uri and the version is still retained.
+// Such requests are answered with 'not modified'.
+//
+// Archives are validated before extraction. Unsafe entries are rejected with 422 and the
+// unsafe_archive code, formats other than tar and zip, whose entries cannot be validated,
+// with 422 and the unsupported_archive code.
+//
+// JSON requests, and requests accepting application/json, get a DownloadResult
+// or an error object with a machine-readable code. Form requests get plain text.
 //
 // e.g. curl -X POST -d "uri=config-1.tar.gz&unarchive=true" localhost:9000/v1/download
-func (d Downloader) HandlerDownload(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-
-	err := r.ParseForm()
+// e.g. curl -X POST -H "Content-Type: application/json" -d '{"uri":"config-1.tar.gz","unarchive":true}' localhost:9000/v1/download
+func (d *Downloader) HandlerDownload(w http.ResponseWriter, r *http.Request) {
+	body, err := parseDownloadBody(r)
 	if err != nil {
-		msg := fmt.Sprintf("parse form failed: %s", err.Error())
-		http.Error(w, msg, http.StatusBadRequest)
+		writeRequestError(w, r, http.StatusBadRequest, CodeInvalidRequest, err)
 		return
 	}
 
-	downloadFrom := r.PostForm.Get("uri")
-	if downloadFrom == "" {
-		http.Error(w, "empty uri field", http.StatusBadRequest)
+	req := downloadRequest{
+		URI:       body.URI,
+		Unarchive: body.Unarchive,
+		Force:     body.Force,
+	}
+	if req.URI == "" {
+		writeRequestError(w, r, http.StatusBadRequest, CodeInvalidRequest, errors.New("empty uri field"))
+		return
+	}
+	if err := validateURI(req.URI); err != nil {
+		writeRequestError(w, r, http.StatusBadRequest, CodeInvalidURI, err)
 		return
 	}
-	reader, err := d.storage.Download(ctx, downloadFrom)
+	req.Checksum, err = body.parseChecksum()
 	if err != nil {
-		msg := fmt.Sprintf("error downloading %s: %s", downloadFrom, err.Error())
-		http.Error(w, msg, http.StatusBadRequest)
+		writeRequestError(w, r, http.StatusBadRequest, CodeInvalidChecksum, err)
 		return
 	}
-	defer reader.Close()
 
-	destinationFile := filepath.Join(d.config.DestPath, filepath.Base(downloadFrom))
-	err = writeToFile(destinationFile, reader)
+	if err := d.accepting(); err != nil {
+		writeDownloadError(w, r, err)
+		return
+	}
+
+	job := newJob(req.URI)
+	if body.Async {
+		d.jobs.add(job)
+		go d.download(context.Background(), req, job)
+
+		w.Header().Set("Location", path.Join(r.URL.Path, "..", "jobs", job.ID))
+		writeJSON(w, http.StatusAccepted, job.snapshot())
+		return
+	}
+
+	result, err := d.download(context.Background(), req, job)
 	if err != nil {
-		log.Warnf("write file error: %s", err.Error())
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeDownloadError(w, r, err)
 		return
 	}
 
-	unarchive := r.PostForm.Get("unarchive")
-	if strings.ToLower(unarchive) == "true" {
-		defer func() {
-			// Delete the downloaded archive
-			err = os.RemoveAll(destinationFile)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if result.NotModified {
+		w.Write([]byte("not modified\n"))
+		return
+	}
+	w.Write([]byte("download success\n"))
+}
+
+// downloadBody holds the fields of a download request, either form or JSON encoded
+type downloadBody struct {
+	URI       string `json:"uri"`
+	Unarchive bool   `json:"unarchive"`
+	Async     bool   `json:"async"`
+	Force     bool   `json:"force"`
+	checksumFields
+}
+
+// checksumFields holds the expected checksum fields of a request
+type checksumFields struct {
+	SHA256 string `json:"sha256"`
+	SHA512 string `json:"sha512"`
+}
+
+// checksum returns the expected checksum field of the algorithm
+func (f checksumFields) checksum(algorithm string) string {
+	switch algorithm {
+	case ChecksumSHA256:
+		return f.SHA256
+	case ChecksumSHA512:
+		return f.SHA512
+	}
+	return ""
+}
+
+// parseChecksum returns the first expected checksum given, nil when there is none
+func (f checksumFields) parseChecksum() (*checksum, error) {
+	for _, algorithm := range checksumAlgorithms {
+		if value := f.checksum(algorithm); value != "" {
+			return newChecksum(algorithm, value)
+		}
+	}
+	return nil, nil
+}
+
+// parseDownloadBody reads the download fields from the JSON body or from the form
+func parseDownloadBody(r *http.Request) (downloadBody, error) {
+	var body downloadBody
+	if isJSON(r) {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&body); err != nil {
+			return body, fmt.Errorf("parse json failed: %s", err.Error())
+		}
+		return body, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return body, fmt.Errorf("parse form failed: %s", err.Error())
+	}
+	body.URI = r.PostForm.Get("uri")
+	body.Unarchive = strings.ToLower(r.PostForm.Get("unarchive")) == "true"
+	body.Async = strings.ToLower(r.PostForm.Get("async")) == "true"
+	body.Force = strings.ToLower(r.PostForm.Get("force")) == "true"
+	body.SHA256 = r.PostForm.Get(ChecksumSHA256)
+	body.SHA512 = r.PostForm.Get(ChecksumSHA512)
+	return body, nil
+}
+
+// downloadRequest contains the parameters of a single download
+type downloadRequest struct {
+	URI       string
+	Unarchive bool
+	// Download the object even when it did not change since the last download
+	Force bool
+
+	// Expected checksum of the downloaded file, nil when not verified
+	Checksum *checksum
+}
+
+// key identifies identical requests
+// destinations returns the entries of DestPath req writes to,
+// the archive and the directory it is extracted to
+func (r downloadRequest) destinations() []string {
+	names := []string{filepath.Base(r.URI)}
+	if r.Unarchive {
+		names = append(names, folderNameFromFileName(r.URI))
+	}
+	return names
+}
+
+func (r downloadRequest) key() string {
+	expected := ""
+	if r.Checksum != nil {
+		expected = r.Checksum.Algorithm + ":" + r.Checksum.Value
+	}
+	return fmt.Sprintf("%s\x00%t\x00%t\x00%s", r.URI, r.Unarchive, r.Force, expected)
+}
+
+// DownloadResult describes a successful download
+type DownloadResult struct {
+	URI string `json:"uri"`
+	// Name of the version in DestPath
+	Version string `json:"version"`
+	// Path of the downloaded file, archives are deleted once extracted
+	Path string `json:"path"`
+	// Number of bytes written to Path
+	Bytes int64 `json:"bytes"`
+	// Checksum of the downloaded file prefixed by its algorithm, e.g. sha256:<hex>
+	Checksum string `json:"checksum"`
+	// Directory the archive was extracted to, empty when not unarchived
+	Dir string `json:"dir,omitempty"`
+	// Whether the download was skipped because the object did not change
+	NotModified bool `json:"not_modified,omitempty"`
+	// Results of the items of a batch download, in request order
+	Items []DownloadResult `json:"items,omitempty"`
+	// Results of the hooks run once the version was activated
+	Hooks []hook.Result `json:"hooks,omitempty"`
+}
+
+// download fetches req.URI from the storage into DestPath and optionally unarchives it,
+// reporting its progress to job.
+// Downloads to the same destination are serialized and identical requests in flight
+// share a single download, the job of the waiting requests only reports the shared result.
+func (d *Downloader) download(ctx context.Context, req downloadRequest, job *Job) (result *DownloadResult, err error) {
+	defer func() {
+		job.finish(result, err)
+	}()
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	result, err, shared := d.flights.do(req.key(), func() (*DownloadResult, error) {
+		unlock := d.destinations.lockAll(req.destinations()...)
+		defer unlock()
+
+		start := time.Now()
+		result, err := d.run(ctx, req, job)
+		switch {
+		case err != nil:
+			d.metrics.downloads.WithLabelValues(resultFailure).Inc()
+			d.notifyFailure(req.URI, result, start, err)
+		case result.NotModified:
+			d.metrics.downloads.WithLabelValues(resultNotModified).Inc()
+		default:
+			d.metrics.downloads.WithLabelValues(resultSuccess).Inc()
+		}
+		return result, err
+	})
+	if shared {
+		log.Debugf("%s: shared the result of an identical download", req.URI)
+	}
+	return result, err
+}
+
+// run downloads req, the destination of req must be locked
+func (d *Downloader) run(ctx context.Context, req downloadRequest, job *Job) (result *DownloadResult, err error) {
+	if err := d.checkNotSynced(req.destinations()...); err != nil {
+		return nil, err
+	}
+	object, err := d.attributes(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	if !req.Force {
+		if result := d.notModified(req, object); result != nil {
+			log.Debugf("%s not modified", req.URI)
+			activated, err := d.activateNotModified(result)
 			if err != nil {
-				log.Warnf("error delete: %s", err.Error())
+				return nil, err
 			}
+			if activated {
+				err = d.activated(ctx, result)
+			}
+			return result, err
+		}
+	}
 
-			// Ensures only 'keepOldCount' number of files are in the downloads directory
-			err = deleteFilesExceedingN(d.config.DestPath, d.config.KeepOldCount)
-			if err != nil {
+	job.setStatus(JobDownloading)
+	start := time.Now()
+	destinationFile := filepath.Join(d.config.DestPath, filepath.Base(req.URI))
+	version, err := d.fetch(ctx, req, object, destinationFile, job)
+	if err != nil {
+		return nil, err
+	}
+	result = &DownloadResult{
+		URI:      req.URI,
+		Version:  version.Name,
+		Path:     destinationFile,
+		Bytes:    version.Size,
+		Checksum: version.Checksum,
+	}
+	d.notify(webhook.Event{
+		Type:     webhook.EventDownload,
+		URI:      req.URI,
+		Version:  version.Name,
+		Dir:      destinationFile,
+		Checksum: version.Checksum,
+		Duration: time.Since(start),
+	})
+
+	if req.Unarchive {
+		defer func() {
+			// Delete the downloaded archive
+			if err := os.RemoveAll(destinationFile); err != nil {
 				log.Warnf("error delete: %s", err.Error())
 			}
+
+			d.prune()
 		}()
 
-		unarchiveDir := filepath.Join(d.config.DestPath, folderNameFromFileName(destinationFile))
-		err = archive.Unarchive(destinationFile, unarchiveDir)
+		job.setStatus(JobExtracting)
+		version.Name = folderNameFromFileName(destinationFile)
+		start := time.Now()
+		dir, err := d.install(destinationFile, version, req.URI, object)
 		if err != nil {
-			log.Warnf("error unarchive: %s\n", err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
+			return nil, err
+		}
+		result.Version = version.Name
+		result.Dir = dir
+		d.notify(webhook.Event{
+			Type:     webhook.EventExtract,
+			URI:      req.URI,
+			Version:  version.Name,
+			Dir:      dir,
+			Checksum: version.Checksum,
+			Duration: time.Since(start),
+		})
+
+		// Hooks run once the version is active, without blocking the pruning
+		if err := d.activated(ctx, result); err != nil {
+			return result, err
 		}
 	}
 
-	log.Debugf("download success")
+	if !req.Unarchive {
+		d.mu.Lock()
+		d.versions[version.Name] = version.downloaded()
+		d.sources[req.URI] = source{Object: object, Version: version.Name}
+		d.persist()
+		d.mu.Unlock()
+	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("download success\n"))
+	log.Debugf("download success")
+	return result, nil
 }
 
-// writeToFile reads from an io.Reader into filepath
-func writeToFile(filepath string, r io.Reader) error {
-	f, err := os.OpenFile(filepath, os.O_CREATE|os.O_RDWR, 0755)
+// attributes returns the attributes of the object of req, and sets the expected checksum of req
+// from its sidecar object when configured
+func (d *Downloader) attributes(ctx context.Context, req *downloadRequest) (storage.Object, error) {
+	object, err := d.storage.Attributes(ctx, req.URI)
 	if err != nil {
-		return err
+		return object, &downloadError{
+			status: http.StatusBadRequest,
+			code:   CodeDownloadFailed,
+			err:    fmt.Errorf("error downloading %s: %s", req.URI, err.Error()),
+		}
+	}
+	if req.Checksum == nil && d.config.ChecksumSidecar {
+		req.Checksum, err = sidecarChecksum(ctx, d.storage, req.URI)
+		if err != nil {
+			return object, &downloadError{
+				status: http.StatusBadRequest,
+				code:   CodeDownloadFailed,
+				err:    err,
+			}
+		}
 	}
+	return object, nil
+}
 
-	_, err = io.Copy(f, r)
+// install extracts the downloaded archive into DestPath, records and activates its version
+func (d *Downloader) install(archiveFile string, version *Version, uri string, object storage.Object) (string, error) {
+	// Pruning waits until the version is extracted and activated
+	d.extractMu.RLock()
+	defer d.extractMu.RUnlock()
+
+	start := time.Now()
+	dir, err := d.extract(archiveFile, version.Name)
+	if err == nil {
+		d.metrics.unarchiveDuration.Observe(time.Since(start).Seconds())
+	}
 	if err != nil {
-		return err
+		return "", unarchiveError(err)
 	}
 
-	if err := f.Close(); err != nil {
-		return err
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sources[uri] = source{Object: object, Version: version.Name}
+	if err := d.activateNew(version); err != nil {
+		return "", err
 	}
+	return dir, nil
+}
 
+// activateNew records and activates version, just installed in DestPath, d.mu must be held
+func (d *Downloader) activateNew(version *Version) error {
+	d.versions[version.Name] = version.downloaded()
+	err := d.activate(version.Name)
+	if err == nil {
+		d.history = append(d.history, version.Name)
+	}
+	d.persist()
+	if err != nil {
+		return &downloadError{
+			status: http.StatusInternalServerError,
+			code:   CodeInternal,
+			err:    fmt.Errorf("error activate: %s", err.Error()),
+		}
+	}
 	return nil
 }
 
-// folderNameFromFileName returns a name for a folder
-// which will be stripped off of its extensions.
-func folderNameFromFileName(filename string) string {
-	base := filepath.Base(filename)
-	firstDot := strings.Index(base, ".")
-	if firstDot > -1 {
-		return base[:firstDot]
+// unarchiveError returns the download error of an extraction error
+func unarchiveError(err error) error {
+	if _, ok := err.(*archive.EntryError); ok {
+		return &downloadError{
+			status: http.StatusUnprocessableEntity,
+			code:   CodeUnsafeArchive,
+			err:    fmt.Errorf("error unarchive: %s", err.Error()),
+		}
 	}
+	if err == archive.ErrUnsupportedArchive {
+		return &downloadError{
+			status: http.StatusUnprocessableEntity,
+			code:   CodeUnsupportedArchive,
+			err:    fmt.Errorf("error unarchive: %s", err.Error()),
+		}
+	}
+	return &downloadError{
+		status: http.StatusInternalServerError,
+		code:   CodeInternal,
+		err:    fmt.Errorf("error unarchive: %s", err.Error()),
+	}
+}
 
-	return base
+// fetch downloads object, the attributes of req.URI, into a hidden partial file and moves it
+// to destinationFile once its checksum and signature are verified
+func (d *Downloader) fetch(ctx context.Context, req downloadRequest, object storage.Object, destinationFile string, job *Job) (*Version, error) {
+	expected := req.Checksum
+
+	// Fetch the signature first, so nothing is written for unsigned artifacts
+	var sig []byte
+	if d.verifier != nil {
+		var err error
+		sig, err = d.fetchSignature(ctx, req.URI)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The checksum is always computed to be recorded with the version
+	algorithm := ChecksumSHA256
+	if expected != nil {
+		algorithm = expected.Algorithm
+	}
+	// The algorithm was validated when the checksum was created
+	h, _ := newHash(algorithm)
+
+	partialFile := filepath.Join(d.config.DestPath, "."+filepath.Base(req.URI)+partialExtension)
+	start := time.Now()
+	err := d.transferPartial(ctx, object, partialFile, h, job)
+	if err != nil {
+		return nil, err
+	}
+	d.metrics.downloadDuration.WithLabelValues(d.storage.Name()).Observe(time.Since(start).Seconds())
+
+	err = d.verify(partialFile, expected, h, sig)
+	if err != nil {
+		// Never leave a corrupted or untrusted file behind
+		if rerr := os.RemoveAll(partialFile); rerr != nil {
+			log.Warnf("error delete: %s", rerr.Error())
+		}
+		return nil, err
+	}
+
+	err = os.Rename(partialFile, destinationFile)
+	if err != nil {
+		os.Remove(partialFile)
+		return nil, &downloadError{
+			status: http.StatusInternalServerError,
+			code:   CodeInternal,
+			err:    fmt.Errorf("write file error: %s", err.Error()),
+		}
+	}
+
+	version := &Version{
+		Name:     filepath.Base(destinationFile),
+		URI:      req.URI,
+		Provider: d.storage.Name(),
+		Bucket:   d.storage.BucketName(),
+		Checksum: algorithm + ":" + hex.EncodeToString(h.Sum(nil)),
+		Size:     object.Size,
+	}
+	return version, nil
 }
 
-// deleteFilesExceedingN deletes files that exceed N
-func deleteFilesExceedingN(dir string, n int) error {
-	var err error
+// verify checks the downloaded file against the expected checksum, computed by h,
+// and against its detached signature when signatures are required
+func (d *Downloader) verify(file string, expected *checksum, h hash.Hash, sig []byte) error {
+	if expected != nil {
+		if err := expected.verify(h); err != nil {
+			return &downloadError{
+				status: http.StatusUnprocessableEntity,
+				code:   CodeChecksumMismatch,
+				err:    err,
+			}
+		}
+	}
+
+	if d.verifier != nil {
+		// Pre-hashed signatures are verified while streaming the file,
+		// the others read at most signature.MaxMessageSize of it
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := d.verifier.VerifyReader(f, sig); err != nil {
+			return &downloadError{
+				status: http.StatusUnprocessableEntity,
+				code:   CodeSignatureInvalid,
+				err:    fmt.Errorf("error verifying signature: %s", err.Error()),
+			}
+		}
+	}
+
+	return nil
+}
 
-	files, err := ioutil.ReadDir(dir)
+// fetchSignature downloads the detached signature of the artifact at uri
+func (d *Downloader) fetchSignature(ctx context.Context, uri string) ([]byte, error) {
+	key := uri + signature.Extension
+	reader, err := d.storage.Download(ctx, key)
+	if storage.IsNotExist(err) {
+		return nil, &downloadError{
+			status: http.StatusUnprocessableEntity,
+			code:   CodeSignatureMissing,
+			err:    fmt.Errorf("%s: %s", ErrSignatureMissing.Error(), key),
+		}
+	}
 	if err != nil {
-		return err
+		return nil, &downloadError{
+			status: http.StatusBadRequest,
+			code:   CodeDownloadFailed,
+			err:    fmt.Errorf("error downloading %s: %s", key, err.Error()),
+		}
 	}
-	sort.Slice(files, func(left, right int) bool {
-		// If syscall.Stat_t do not exists (tough luck!)
-		// sort by last modified time, newest to oldest
-		if _, ok := files[left].Sys().(*syscall.Stat_t); !ok {
-			return files[left].ModTime().UnixNano() > files[right].ModTime().UnixNano()
+	defer reader.Close()
+
+	sig, err := ioutil.ReadAll(io.LimitReader(reader, maxSignatureSize))
+	if err != nil {
+		return nil, &downloadError{
+			status: http.StatusBadRequest,
+			code:   CodeDownloadFailed,
+			err:    fmt.Errorf("error downloading %s: %s", key, err.Error()),
 		}
+	}
+	return sig, nil
+}
 
-		// If the OS rocks, sort by file's last accessed time
-		// We want to sort by last accessed time to avoid deleting files that are still
-		// being used, e.g. they are reverting configuration to older ones
-		leftAccessTime := files[left].Sys().(*syscall.Stat_t).Atim
-		rightAccessTime := files[right].Sys().(*syscall.Stat_t).Atim
-		return leftAccessTime.Nsec > rightAccessTime.Nsec
-	})
+// validateURI makes sure the file downloaded from uri, and the folder it is unarchived to,
+// are plain entries of DestPath
+func validateURI(uri string) error {
+	base := filepath.Base(uri)
+	if strings.HasSuffix(uri, "/") || base == "/" || !isVersionEntry(base) || !isVersionEntry(folderNameFromFileName(base)) {
+		return fmt.Errorf("%s: %q", ErrInvalidURI.Error(), uri)
+	}
+	return nil
+}
 
-	// This essentially removes files[n:]
-	for i := n; i < len(files); i++ {
-		path := filepath.Join(dir, files[i].Name())
-		err = os.RemoveAll(path)
+// folderNameFromFileName returns a name for a folder
+// which will be stripped off of its extensions.
+func folderNameFromFileName(filename string) string {
+	base := filepath.Base(filename)
+	firstDot := strings.Index(base, ".")
+	if firstDot > -1 {
+		return base[:firstDot]
 	}
 
-	return err
+	return base
 }
@@ -1,8 +1,8 @@
 package downloader
 
 import (
+	"archive/tar"
 	"context"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -11,26 +11,20 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
-	"time"
 
+	"github.com/albertwidi/akouste/pkg/archive"
 	"github.com/albertwidi/akouste/pkg/storage"
 	"github.com/albertwidi/akouste/pkg/storage/local"
 	"github.com/stretchr/testify/assert"
 )
 
 var cfg Config
-var downloader *Downloader
 
 func TestNew(t *testing.T) {
-	localProvider, err := local.New(local.Config{Bucket: "."})
-	assert.NoError(t, err)
-	strg := storage.New(localProvider)
+	d, _, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
 
-	downloader, err = New(context.TODO(), strg, Config{
-		DestPath:     ".",
-		KeepOldCount: 2,
-	})
-	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(d.config.DestPath, StateDir, stateFile))
 }
 
 func TestHandlerDownload(t *testing.T) {
@@ -38,10 +32,10 @@ func TestHandlerDownload(t *testing.T) {
 	testunarchive := "false"
 	testcontent := "hello"
 
-	// Can I use internal function of the package I'm testing? o.O
-	err := writeToFile(testfile, strings.NewReader(testcontent))
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	err := ioutil.WriteFile(filepath.Join(bucket, testfile), []byte(testcontent), 0644)
 	assert.NoError(t, err)
-	defer os.Remove(testfile)
 
 	// Post form values
 	form := url.Values{}
@@ -52,7 +46,7 @@ func TestHandlerDownload(t *testing.T) {
 
 	// Test HandlerDownload
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(downloader.HandlerDownload)
+	handler := http.HandlerFunc(d.HandlerDownload)
 	handler.ServeHTTP(rr, request)
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v",
@@ -60,8 +54,9 @@ func TestHandlerDownload(t *testing.T) {
 	}
 
 	// Check downloaded testfile content
-	f, err := os.Open(testfile)
+	f, err := os.Open(filepath.Join(d.config.DestPath, testfile))
 	assert.NoError(t, err)
+	defer f.Close()
 	downloadedcontent, err := ioutil.ReadAll(f)
 	assert.NoError(t, err)
 	assert.Equal(t, string(downloadedcontent), testcontent)
@@ -69,53 +64,86 @@ func TestHandlerDownload(t *testing.T) {
 	// TODO test KeepOldCount behaviour too
 }
 
-func TestDeleteFilesExceedingN(t *testing.T) {
-	testfilelist := []string{}
-	testfiledir := "testfile"
+func TestFolderNameFromFileName(t *testing.T) {
+	testfilename := "path/to/file/filename.tar.gz"
+	expect := "filename"
+	result := folderNameFromFileName(testfilename)
+	assert.Equal(t, expect, result)
+}
+
+// newTestDownloader returns a downloader using temporary bucket and destination directories,
+// the directories are removed by the returned cleanup function
+func newTestDownloader(t *testing.T, config Config) (d *Downloader, bucket string, cleanup func()) {
+	bucket, err := ioutil.TempDir("", "akouste-bucket")
+	assert.NoError(t, err)
+	config.DestPath, err = ioutil.TempDir("", "akouste-downloads")
+	assert.NoError(t, err)
 
-	err := os.Mkdir(testfiledir, os.ModePerm)
+	localProvider, err := local.New(local.Config{Bucket: bucket})
 	assert.NoError(t, err)
-	defer os.RemoveAll(testfiledir)
 
-	// Generate 3 dummy files
-	for i := 0; i < 3; i++ {
-		filepath := filepath.Join(testfiledir, fmt.Sprintf("test-%d", i))
-		f, err := os.OpenFile(filepath, os.O_CREATE|os.O_RDWR, 0755)
-		assert.NoError(t, err)
+	d, err = New(context.TODO(), storage.New(localProvider), config)
+	assert.NoError(t, err)
 
-		w := strings.NewReader("test")
-		_, err = w.WriteTo(f)
-		assert.NoError(t, err)
-		f.Close()
+	return d, bucket, func() {
+		os.RemoveAll(bucket)
+		os.RemoveAll(config.DestPath)
+	}
+}
 
-		testfilelist = append(testfilelist, filepath)
+// postForm sends form to handler and returns the recorded response
+func postForm(handler http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-		// Since the test is related to file's last modified time,
-		// we wait 0.1 second between files generation
-		// because the sorting is done in the nanosecond precision level anyway
-		time.Sleep(100 * time.Millisecond)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	return rr
+}
+
+func TestHandlerDownloadInvalidURI(t *testing.T) {
+	d, _, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+
+	for _, uri := range []string{"..", "../..", "/", "dir/", ".akouste", "config/.hidden.tar.gz", "current", "current.tar.gz"} {
+		rr := postForm(d.HandlerDownload, url.Values{"uri": {uri}, "unarchive": {"true"}})
+		assert.Equal(t, http.StatusBadRequest, rr.Code, uri)
+		assert.Contains(t, rr.Body.String(), ErrInvalidURI.Error(), uri)
 	}
+}
 
-	n := 2
-	// We know it's already ordered from oldest to newest, get last n elements
-	expect := testfilelist[len(testfilelist)-n:]
-	err = deleteFilesExceedingN(testfiledir, n)
-	assert.NoError(t, err)
+func TestHandlerDownloadUnsafeArchive(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
 
-	// Check if generated files left in the directory matches expect
-	generatedtestfiles, err := ioutil.ReadDir(testfiledir)
+	f, err := os.Create(filepath.Join(bucket, "evil.tar"))
 	assert.NoError(t, err)
-	generatedtestfilelist := []string{}
-	for i := 0; i < len(generatedtestfiles); i++ {
-		generatedtestfilelist = append(generatedtestfilelist,
-			filepath.Join(testfiledir, generatedtestfiles[i].Name()))
-	}
-	assert.Equal(t, expect, generatedtestfilelist)
+	tw := tar.NewWriter(f)
+	err = tw.WriteHeader(&tar.Header{Name: "../evil.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	assert.NoError(t, err)
+	_, err = tw.Write([]byte("evil"))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, f.Close())
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"evil.tar"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), archive.ErrPathTraversal.Error())
+
+	assertEmptyDir(t, d.config.DestPath)
+	_, err = os.Stat(filepath.Join(filepath.Dir(d.config.DestPath), "evil.txt"))
+	assert.True(t, os.IsNotExist(err))
 }
 
-func TestFolderNameFromFileName(t *testing.T) {
-	testfilename := "path/to/file/filename.tar.gz"
-	expect := "filename"
-	result := folderNameFromFileName(testfilename)
-	assert.Equal(t, expect, result)
+func TestHandlerDownloadUnsupportedArchive(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	err := ioutil.WriteFile(filepath.Join(bucket, "config-1.rar"), []byte("Rar!"), 0644)
+	assert.NoError(t, err)
+
+	rr := postJSON(d.HandlerDownload, `{"uri":"config-1.rar","unarchive":true}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Equal(t, CodeUnsupportedArchive, decodeError(t, rr).Code)
+	_, err = os.Stat(filepath.Join(d.config.DestPath, "config-1"))
+	assert.True(t, os.IsNotExist(err))
 }
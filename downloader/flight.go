@@ -0,0 +1,113 @@
+package downloader
+
+import (
+	"sort"
+	"sync"
+)
+
+// flightCall is a download in flight, or done, shared by identical requests
+type flightCall struct {
+	wg     sync.WaitGroup
+	result *DownloadResult
+	err    error
+}
+
+// flightGroup collapses identical download requests in flight into a single download
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do runs fn unless a call with the same key is in flight, in which case it waits for
+// that call and returns its result. shared is true when the result came from another call.
+func (g *flightGroup) do(key string, fn func() (*DownloadResult, error)) (result *DownloadResult, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.result, c.err, true
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+
+	c.result, c.err = fn()
+	return c.result, c.err, false
+}
+
+// keyedMutex serializes work per key, e.g. per destination in DestPath
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu sync.Mutex
+	// Number of holders and waiters, the lock is forgotten when it drops to zero
+	refs int
+}
+
+// lock locks key and returns the function unlocking it
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		m.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// lockAll locks every key and returns the function unlocking them.
+// Keys are locked in order, so callers sharing some of their keys cannot deadlock.
+func (m *keyedMutex) lockAll(keys ...string) func() {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	unlocks := []func(){}
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		unlocks = append(unlocks, m.lock(key))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// locked returns true if key is locked or waited for
+func (m *keyedMutex) locked(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.locks[key]
+	return ok
+}
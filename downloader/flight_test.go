@@ -0,0 +1,175 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	release := make(chan struct{})
+	want := &DownloadResult{URI: "config-1.tar.gz"}
+
+	var wg sync.WaitGroup
+	results := make([]*DownloadResult, 5)
+	sharedCount := int32(0)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err, shared := g.do("config-1.tar.gz", func() (*DownloadResult, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return want, nil
+			})
+			assert.NoError(t, err)
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+			results[i] = result
+		}(i)
+	}
+
+	// Let every caller join the call in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, int32(len(results)-1), sharedCount)
+	for _, result := range results {
+		assert.Equal(t, want, result)
+	}
+
+	// Once done, the next call runs again
+	g.do("config-1.tar.gz", func() (*DownloadResult, error) {
+		atomic.AddInt32(&calls, 1)
+		return want, nil
+	})
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestKeyedMutex(t *testing.T) {
+	var m keyedMutex
+	var running, maxRunning int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := m.lock("config-1.tar.gz")
+			defer unlock()
+
+			n := atomic.AddInt32(&running, 1)
+			if n > atomic.LoadInt32(&maxRunning) {
+				atomic.StoreInt32(&maxRunning, n)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	// Other keys are not blocked
+	unlock := m.lock("config-2.tar.gz")
+	assert.True(t, m.locked("config-2.tar.gz"))
+	unlock()
+	assert.False(t, m.locked("config-2.tar.gz"))
+	wg.Wait()
+
+	assert.Equal(t, int32(1), maxRunning)
+	assert.Empty(t, m.locks)
+}
+
+func TestKeyedMutexLockAll(t *testing.T) {
+	var m keyedMutex
+
+	// Overlapping keys in any order do not deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		keys := []string{"config-1", "config-1.tar.gz", "config-1"}
+		if i%2 == 0 {
+			keys = []string{"config-1.tar.gz", "config-1"}
+		}
+		wg.Add(1)
+		go func(keys []string) {
+			defer wg.Done()
+			unlock := m.lockAll(keys...)
+			assert.True(t, m.locked("config-1"))
+			assert.True(t, m.locked("config-1.tar.gz"))
+			unlock()
+		}(keys)
+	}
+	wg.Wait()
+	assert.Empty(t, m.locks)
+}
+
+func TestDownloadLocksExtractedFolder(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+
+	// e.g. config-1.zip being extracted to the same folder
+	unlock := d.destinations.lock("config-1")
+	done := make(chan int)
+	go func() {
+		rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+		done <- rr.Code
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("download did not wait for its extracted folder")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestHandlerDownloadConcurrent(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+	copyFixture(t, bucket, "config-3.tar.gz")
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 12)
+	for i := 0; i < 4; i++ {
+		for _, uri := range []string{"config-1.tar.gz", "config-2.tar.gz", "config-3.tar.gz"} {
+			wg.Add(1)
+			go func(uri string) {
+				defer wg.Done()
+				rr := postForm(d.HandlerDownload, url.Values{"uri": {uri}, "unarchive": {"true"}})
+				codes <- rr.Code
+			}(uri)
+		}
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	// Only complete versions are left, and no staging or partial files
+	entries, err := ioutil.ReadDir(d.config.DestPath)
+	assert.NoError(t, err)
+	for _, entry := range entries {
+		if entry.Name() == CurrentLink || entry.Name() == StateDir {
+			continue
+		}
+		assert.True(t, entry.IsDir(), entry.Name())
+		assert.True(t, isVersionEntry(entry.Name()), entry.Name())
+	}
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(d.config.DestPath, active, "test1.yaml"))
+}
@@ -0,0 +1,142 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Error variables
+var (
+	ErrLowFreeSpace    = errors.New("free space below the minimum")
+	ErrNoActiveVersion = errors.New("no active version")
+)
+
+// Statuses of the health checks
+const (
+	CheckOK   = "ok"
+	CheckFail = "fail"
+)
+
+// readyTimeout bounds the readiness checks, the storage check in particular
+const readyTimeout = 5 * time.Second
+
+// Check is the result of a single health check
+type Check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Free space of DestPath in bytes, for the dest_path check
+	FreeBytes int64 `json:"free_bytes,omitempty"`
+	// Name of the active version, for the active_version check
+	Version string `json:"version,omitempty"`
+}
+
+// Health is the result of the health checks, Status is CheckFail when any check failed
+type Health struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+func newCheck(err error) Check {
+	if err != nil {
+		return Check{Status: CheckFail, Error: err.Error()}
+	}
+	return Check{Status: CheckOK}
+}
+
+// Ready checks the downloader can serve downloads: it is not shutting down, the storage
+// can be listed and DestPath is writable with at least MinFreeSpace bytes free.
+// The active version is checked when RequireActiveVersion is set.
+func (d *Downloader) Ready(ctx context.Context) Health {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	checks := map[string]Check{}
+	checks["shutdown"] = newCheck(d.accepting())
+	checks["storage"] = newCheck(d.storage.Ping(ctx))
+	checks["dest_path"] = d.checkDestPath()
+	if d.config.RequireActiveVersion {
+		checks["active_version"] = d.checkActiveVersion()
+	}
+
+	health := Health{Status: CheckOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status != CheckOK {
+			health.Status = CheckFail
+		}
+	}
+	return health
+}
+
+// checkDestPath writes a probe file to DestPath and checks its free space
+func (d *Downloader) checkDestPath() Check {
+	f, err := ioutil.TempFile(d.config.DestPath, probePrefix)
+	if err != nil {
+		return newCheck(err)
+	}
+	_, err = f.Write([]byte("probe"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return newCheck(err)
+	}
+
+	free, err := freeSpace(d.config.DestPath)
+	if err != nil {
+		return newCheck(err)
+	}
+	check := newCheck(nil)
+	if free < d.config.MinFreeSpace {
+		check = newCheck(fmt.Errorf("%s: %d < %d bytes", ErrLowFreeSpace.Error(), free, d.config.MinFreeSpace))
+	}
+	check.FreeBytes = free
+	return check
+}
+
+func (d *Downloader) checkActiveVersion() Check {
+	active, err := d.activeVersion()
+	if err == nil && active == "" {
+		err = ErrNoActiveVersion
+	}
+	check := newCheck(err)
+	check.Version = active
+	return check
+}
+
+// freeSpace returns the number of bytes available to unprivileged users on the filesystem of path
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// HandlerHealthz answers whether the downloader is alive, it does not check its dependencies
+//
+// e.g. curl localhost:9000/v1/healthz
+func (d *Downloader) HandlerHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Health{Status: CheckOK})
+}
+
+// HandlerReadyz answers whether the downloader is ready to serve downloads with the result
+// of each check, 503 Service Unavailable when any check failed
+//
+// e.g. curl localhost:9000/v1/readyz
+func (d *Downloader) HandlerReadyz(w http.ResponseWriter, r *http.Request) {
+	health := d.Ready(r.Context())
+	status := http.StatusOK
+	if health.Status != CheckOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, health)
+}
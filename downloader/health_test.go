@@ -0,0 +1,91 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getReadyz returns the status code and health of a readiness request
+func getReadyz(t *testing.T, d *Downloader) (int, Health) {
+	rr := httptest.NewRecorder()
+	d.HandlerReadyz(rr, httptest.NewRequest("GET", "/v1/readyz", nil))
+	var health Health
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &health))
+	return rr.Code, health
+}
+
+func TestHandlerHealthz(t *testing.T) {
+	d, _, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+
+	rr := httptest.NewRecorder()
+	d.HandlerHealthz(rr, httptest.NewRequest("GET", "/v1/healthz", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rr.Body.String())
+}
+
+func TestHandlerReadyz(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2, RequireActiveVersion: true})
+	defer cleanup()
+
+	// No version is active yet
+	code, health := getReadyz(t, d)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, CheckFail, health.Status)
+	assert.Equal(t, CheckOK, health.Checks["shutdown"].Status)
+	assert.Equal(t, CheckOK, health.Checks["storage"].Status)
+	assert.Equal(t, CheckOK, health.Checks["dest_path"].Status)
+	assert.True(t, health.Checks["dest_path"].FreeBytes > 0)
+	assert.Equal(t, Check{Status: CheckFail, Error: ErrNoActiveVersion.Error()}, health.Checks["active_version"])
+
+	copyFixture(t, bucket, "config-1.tar.gz")
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	code, health = getReadyz(t, d)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, CheckOK, health.Status)
+	assert.Equal(t, "config-1", health.Checks["active_version"].Version)
+
+	// The probe file is not left behind
+	entries, err := ioutil.ReadDir(d.config.DestPath)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{StateDir, "config-1", CurrentLink}, names)
+
+	d.config.MinFreeSpace = 1 << 62
+	code, health = getReadyz(t, d)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, health.Checks["dest_path"].Error, ErrLowFreeSpace.Error())
+	d.config.MinFreeSpace = 0
+
+	assert.NoError(t, os.RemoveAll(bucket))
+	code, health = getReadyz(t, d)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, CheckFail, health.Checks["storage"].Status)
+	assert.NotEmpty(t, health.Checks["storage"].Error)
+}
+
+func TestReadyShutdown(t *testing.T) {
+	d, _, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+
+	assert.Equal(t, CheckOK, d.Ready(context.Background()).Status)
+	_, ok := d.Ready(context.Background()).Checks["active_version"]
+	assert.False(t, ok)
+
+	assert.NoError(t, d.Shutdown(context.Background()))
+	health := d.Ready(context.Background())
+	assert.Equal(t, CheckFail, health.Status)
+	assert.Equal(t, Check{Status: CheckFail, Error: ErrShuttingDown.Error()}, health.Checks["shutdown"])
+}
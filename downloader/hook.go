@@ -0,0 +1,99 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/albertwidi/akouste/pkg/hook"
+	"github.com/albertwidi/akouste/pkg/log"
+)
+
+// Error variables
+var (
+	ErrHookFailed = errors.New("hook failed")
+)
+
+// hookEnv describes the version name to the hooks, d.mu must be held
+func (d *Downloader) hookEnv(event, name string) hook.Env {
+	env := hook.Env{
+		Event:   event,
+		Version: name,
+		Dir:     filepath.Join(d.config.DestPath, name),
+	}
+	if version, ok := d.versions[name]; ok {
+		env.URI = version.URI
+		env.Checksum = version.Checksum
+	}
+	return env
+}
+
+// runHooks runs the configured hooks one after the other and logs their results
+func (d *Downloader) runHooks(ctx context.Context, env hook.Env) []hook.Result {
+	results := []hook.Result{}
+	for _, h := range d.config.Hooks {
+		result := h.Run(ctx, env)
+		if result.Failed() {
+			log.Warnf("%s hook %s failed for %s (exit status %d): %s: %s", env.Event, result.Hook, env.Version, result.ExitStatus, result.Error, result.Output)
+		} else {
+			log.Infof("%s hook %s succeeded for %s in %s", env.Event, result.Hook, env.Version, result.Duration)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// activated runs the hooks once the version of result is activated and records their results.
+// When a hook fails and RollbackOnHookFailure is set, the previous version is activated again
+// and an error is returned.
+func (d *Downloader) activated(ctx context.Context, result *DownloadResult) error {
+	if len(d.config.Hooks) == 0 {
+		return nil
+	}
+
+	result.Hooks = d.runHooks(ctx, hook.Env{
+		Event:    hook.EventActivate,
+		Version:  result.Version,
+		Dir:      result.Dir,
+		URI:      result.URI,
+		Checksum: result.Checksum,
+	})
+	failed := []string{}
+	for _, r := range result.Hooks {
+		if r.Failed() {
+			failed = append(failed, r.Hook)
+		}
+	}
+	if len(failed) == 0 || !d.config.RollbackOnHookFailure {
+		return nil
+	}
+
+	err := fmt.Errorf("%s: %s", ErrHookFailed.Error(), strings.Join(failed, ", "))
+	d.mu.Lock()
+	active, aerr := d.activeVersion()
+	if aerr != nil || active != result.Version {
+		// Another version was activated in the meantime, it is left alone
+		d.mu.Unlock()
+		return &downloadError{status: http.StatusBadGateway, code: CodeHookFailed, err: err}
+	}
+	version, rerr := d.rollback("")
+	env := d.hookEnv(hook.EventRollback, version)
+	d.mu.Unlock()
+	if rerr != nil {
+		return &downloadError{
+			status: http.StatusBadGateway,
+			code:   CodeHookFailed,
+			err:    fmt.Errorf("%s, error rollback: %s", err.Error(), rerr.Error()),
+		}
+	}
+
+	d.runHooks(ctx, env)
+	return &downloadError{
+		status: http.StatusBadGateway,
+		code:   CodeHookFailed,
+		err:    fmt.Errorf("%s, rolled back to %s", err.Error(), version),
+	}
+}
@@ -0,0 +1,146 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/albertwidi/akouste/pkg/hook"
+	"github.com/stretchr/testify/assert"
+)
+
+// testHook records the environments it is run with and fails for the versions in fail
+type testHook struct {
+	mu   sync.Mutex
+	envs []hook.Env
+	fail map[string]bool
+}
+
+func (h *testHook) String() string {
+	return "test"
+}
+
+func (h *testHook) Run(ctx context.Context, env hook.Env) hook.Result {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.envs = append(h.envs, env)
+	result := hook.Result{Hook: h.String(), Output: env.Event + " " + env.Version}
+	if h.fail[env.Version] {
+		result.ExitStatus = 1
+		result.Error = "exit status 1"
+	}
+	return result
+}
+
+func TestHooks(t *testing.T) {
+	h := &testHook{}
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5, Hooks: []hook.Hook{h}})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+
+	rr := postJSON(d.HandlerDownload, `{"uri":"config-1.tar.gz","unarchive":true}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result DownloadResult
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Len(t, result.Hooks, 1)
+	assert.Equal(t, "activate config-1", result.Hooks[0].Output)
+	assert.False(t, result.Hooks[0].Failed())
+
+	assert.Len(t, h.envs, 1)
+	assert.Equal(t, hook.Env{
+		Event:    hook.EventActivate,
+		Version:  "config-1",
+		Dir:      filepath.Join(d.config.DestPath, "config-1"),
+		URI:      "config-1.tar.gz",
+		Checksum: result.Checksum,
+	}, h.envs[0])
+
+	// Plain downloads activate nothing
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-2.tar.gz"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, h.envs, 1)
+
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-2.tar.gz"}, "unarchive": {"true"}, "force": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, h.envs, 2)
+
+	// Unchanged archives run the hooks only when they are activated again
+	_, err := d.Rollback("")
+	assert.NoError(t, err)
+	assert.Len(t, h.envs, 3)
+	assert.Equal(t, hook.EventRollback, h.envs[2].Event)
+	assert.Equal(t, "config-1", h.envs[2].Version)
+	assert.Equal(t, "config-1.tar.gz", h.envs[2].URI)
+
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-2.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, "not modified\n", rr.Body.String())
+	assert.Len(t, h.envs, 4)
+	assert.Equal(t, hook.EventActivate, h.envs[3].Event)
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-2.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, "not modified\n", rr.Body.String())
+	assert.Len(t, h.envs, 4)
+}
+
+func TestHookFailure(t *testing.T) {
+	h := &testHook{fail: map[string]bool{"config-2": true}}
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5, Hooks: []hook.Hook{h}})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Failures are only recorded unless RollbackOnHookFailure is set
+	rr = postJSON(d.HandlerDownload, `{"uri":"config-2.tar.gz","unarchive":true}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result DownloadResult
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Len(t, result.Hooks, 1)
+	assert.True(t, result.Hooks[0].Failed())
+	assert.Equal(t, 1, result.Hooks[0].ExitStatus)
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-2", active)
+}
+
+func TestHookFailureRollback(t *testing.T) {
+	h := &testHook{fail: map[string]bool{"config-2": true}}
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5, Hooks: []hook.Hook{h}, RollbackOnHookFailure: true})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	job := newJob("config-2.tar.gz")
+	_, err := d.download(context.TODO(), downloadRequest{URI: "config-2.tar.gz", Unarchive: true}, job)
+	assert.Error(t, err)
+	status, code := errorStatus(err)
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, CodeHookFailed, code)
+
+	// The job keeps the failed hook results
+	snapshot := job.snapshot()
+	assert.Equal(t, JobFailed, snapshot.Status)
+	assert.Equal(t, CodeHookFailed, snapshot.ErrorCode)
+	assert.Len(t, snapshot.Result.Hooks, 1)
+	assert.True(t, snapshot.Result.Hooks[0].Failed())
+
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", active)
+	assert.Equal(t, []string{"config-1"}, d.history)
+	assert.Len(t, h.envs, 3)
+	assert.Equal(t, hook.EventRollback, h.envs[2].Event)
+	assert.Equal(t, "config-1", h.envs[2].Version)
+
+	// The failed version is kept, it can be activated by hand
+	assert.True(t, isRetainedVersion(d.config.DestPath, "config-2"))
+}
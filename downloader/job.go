@@ -0,0 +1,178 @@
+package downloader
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// JobStatus of a download job
+type JobStatus string
+
+// List of job status
+const (
+	JobQueued      JobStatus = "queued"
+	JobDownloading JobStatus = "downloading"
+	JobExtracting  JobStatus = "extracting"
+	JobDone        JobStatus = "done"
+	JobFailed      JobStatus = "failed"
+)
+
+// maxFinishedJobs is the number of finished jobs kept for status queries
+const maxFinishedJobs = 100
+
+// Job tracks the progress of a single download
+type Job struct {
+	mu sync.Mutex
+
+	ID               string    `json:"id"`
+	URI              string    `json:"uri"`
+	Status           JobStatus `json:"status"`
+	BytesTransferred int64     `json:"bytes_transferred"`
+	Error            string    `json:"error,omitempty"`
+	ErrorCode        string    `json:"error_code,omitempty"`
+	// Result of the download once done
+	Result    *DownloadResult `json:"result,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+func newJob(uri string) *Job {
+	now := time.Now()
+	return &Job{
+		ID:        newJobID(),
+		URI:       uri,
+		Status:    JobQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// newJobID returns a random hex encoded job ID
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Fallback to time based ID, uniqueness is still good enough for job lookups
+		return hex.EncodeToString([]byte(time.Now().Format(time.RFC3339Nano)))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Write counts the bytes transferred, it allows Job to be used as an io.Writer
+// with io.TeeReader on the downloaded content
+func (j *Job) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	j.BytesTransferred += int64(len(p))
+	j.UpdatedAt = time.Now()
+	j.mu.Unlock()
+	return len(p), nil
+}
+
+func (j *Job) setStatus(status JobStatus) {
+	j.mu.Lock()
+	j.Status = status
+	j.UpdatedAt = time.Now()
+	j.mu.Unlock()
+}
+
+// finish marks the job as done with its result, or failed when err is not nil
+func (j *Job) finish(result *DownloadResult, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.Status = JobDone
+	j.Result = result
+	if err != nil {
+		j.Status = JobFailed
+		j.Error = err.Error()
+		_, j.ErrorCode = errorStatus(err)
+	}
+	j.UpdatedAt = time.Now()
+}
+
+func (j *Job) finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// snapshot returns a copy of the job safe to be encoded
+func (j *Job) snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &Job{
+		ID:               j.ID,
+		URI:              j.URI,
+		Status:           j.Status,
+		BytesTransferred: j.BytesTransferred,
+		Error:            j.Error,
+		ErrorCode:        j.ErrorCode,
+		Result:           j.Result,
+		CreatedAt:        j.CreatedAt,
+		UpdatedAt:        j.UpdatedAt,
+	}
+}
+
+// jobStore keeps track of asynchronous jobs
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{
+		jobs: make(map[string]*Job),
+	}
+}
+
+// add stores job, forgetting the oldest finished jobs when there are too many of them
+func (s *jobStore) add(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = job
+
+	finished := []*Job{}
+	for _, j := range s.jobs {
+		if j.finished() {
+			finished = append(finished, j)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(left, right int) bool {
+		return finished[left].CreatedAt.Before(finished[right].CreatedAt)
+	})
+	for _, j := range finished[:len(finished)-maxFinishedJobs] {
+		delete(s.jobs, j.ID)
+	}
+}
+
+func (s *jobStore) get(id string) (*Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// HandlerJob returns the status of an asynchronous download job as JSON
+// The job ID is taken from the 'id' route variable
+//
+// e.g. curl localhost:9000/v1/jobs/3f2a...
+func (d *Downloader) HandlerJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	job, ok := d.jobs.get(id)
+	if !ok {
+		writeRequestError(w, r, http.StatusNotFound, CodeJobNotFound, errors.New("job not found"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
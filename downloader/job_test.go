@@ -0,0 +1,89 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerDownloadAsync(t *testing.T) {
+	testfile := "testfile-async.txt"
+	testcontent := "hello async"
+
+	d, bucket, cleanup := newTestDownloader(t, Config{})
+	defer cleanup()
+	err := ioutil.WriteFile(filepath.Join(bucket, testfile), []byte(testcontent), 0644)
+	assert.NoError(t, err)
+
+	router := mux.NewRouter()
+	router.Methods("POST").Path("/v1/download").HandlerFunc(d.HandlerDownload)
+	router.Methods("GET").Path("/v1/jobs/{id}").HandlerFunc(d.HandlerJob)
+
+	form := url.Values{}
+	form.Add("uri", testfile)
+	form.Add("async", "true")
+	request := httptest.NewRequest("POST", "/v1/download", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, request)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	accepted := Job{}
+	err = json.NewDecoder(rr.Body).Decode(&accepted)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, accepted.ID)
+	assert.Equal(t, "/v1/jobs/"+accepted.ID, rr.Header().Get("Location"))
+
+	// Poll the job until it is finished
+	job := Job{}
+	for i := 0; i < 50; i++ {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/jobs/"+accepted.ID, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		job = Job{}
+		err = json.NewDecoder(rr.Body).Decode(&job)
+		assert.NoError(t, err)
+		if job.Status == JobDone || job.Status == JobFailed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, int64(len(testcontent)), job.BytesTransferred)
+	assert.Empty(t, job.Error)
+}
+
+func TestHandlerJobNotFound(t *testing.T) {
+	d, _, cleanup := newTestDownloader(t, Config{})
+	defer cleanup()
+
+	router := mux.NewRouter()
+	router.Methods("GET").Path("/v1/jobs/{id}").HandlerFunc(d.HandlerJob)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/jobs/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestDownloadJobFailed(t *testing.T) {
+	d, _, cleanup := newTestDownloader(t, Config{})
+	defer cleanup()
+
+	job := newJob("does-not-exist.txt")
+	_, err := d.download(context.TODO(), downloadRequest{URI: job.URI}, job)
+	assert.Error(t, err)
+	assert.Equal(t, JobFailed, job.Status)
+	assert.NotEmpty(t, job.Error)
+}
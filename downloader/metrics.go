@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"github.com/albertwidi/akouste/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of the downloads counted by the downloads metric
+const (
+	resultSuccess     = "success"
+	resultNotModified = "not_modified"
+	resultFailure     = "failure"
+)
+
+// metrics of the downloader, exposed with RegisterMetrics
+type metrics struct {
+	downloads          *prometheus.CounterVec
+	downloadDuration   *prometheus.HistogramVec
+	downloadedBytes    *prometheus.CounterVec
+	unarchiveDuration  prometheus.Histogram
+	retentionDeletions prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		downloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "akouste",
+			Subsystem: "downloader",
+			Name:      "downloads_total",
+			Help:      "Number of downloads by result (success, not_modified, failure).",
+		}, []string{"result"}),
+		downloadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "akouste",
+			Subsystem: "downloader",
+			Name:      "storage_download_duration_seconds",
+			Help:      "Time taken to download objects from the storage provider, resumes included.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, []string{"provider"}),
+		downloadedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "akouste",
+			Subsystem: "downloader",
+			Name:      "downloaded_bytes_total",
+			Help:      "Number of bytes downloaded from the storage provider.",
+		}, []string{"provider"}),
+		unarchiveDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "akouste",
+			Subsystem: "downloader",
+			Name:      "unarchive_duration_seconds",
+			Help:      "Time taken to extract archives.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+		retentionDeletions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "akouste",
+			Subsystem: "downloader",
+			Name:      "retention_deletions_total",
+			Help:      "Number of versions deleted by the retention policies.",
+		}),
+	}
+}
+
+// Descriptions of the metrics computed when collected
+var (
+	activeVersionDesc = prometheus.NewDesc(
+		"akouste_downloader_active_version_info",
+		"The active version, always 1.",
+		[]string{"version", "uri", "checksum"}, nil,
+	)
+	destPathBytesDesc = prometheus.NewDesc(
+		"akouste_downloader_dest_path_bytes",
+		"Size in bytes of the files in the download directory.",
+		nil, nil,
+	)
+)
+
+// collector computes the active version and disk usage metrics when collected
+type collector struct {
+	d *Downloader
+}
+
+// Describe implements prometheus.Collector
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeVersionDesc
+	ch <- destPathBytesDesc
+}
+
+// Collect implements prometheus.Collector
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	c.d.mu.Lock()
+	active, err := c.d.activeVersion()
+	var uri, checksum string
+	if version, ok := c.d.versions[active]; ok {
+		uri, checksum = version.URI, version.Checksum
+	}
+	c.d.mu.Unlock()
+	if err != nil {
+		log.Warnf("error collecting active version: %s", err.Error())
+	} else if active != "" {
+		ch <- prometheus.MustNewConstMetric(activeVersionDesc, prometheus.GaugeValue, 1, active, uri, checksum)
+	}
+
+	size, err := diskUsage(c.d.config.DestPath)
+	if err != nil {
+		// Files may be deleted while they are walked, the next collection will be right
+		log.Debugf("error collecting disk usage: %s", err.Error())
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(destPathBytesDesc, prometheus.GaugeValue, float64(size))
+}
+
+// RegisterMetrics registers the metrics of the downloader to registerer
+func (d *Downloader) RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		d.metrics.downloads,
+		d.metrics.downloadDuration,
+		d.metrics.downloadedBytes,
+		d.metrics.unarchiveDuration,
+		d.metrics.retentionDeletions,
+		collector{d: d},
+	} {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
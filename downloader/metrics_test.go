@@ -0,0 +1,78 @@
+package downloader
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// gather returns the metrics of registry by name
+func gather(t *testing.T, registry *prometheus.Registry) map[string]*dto.MetricFamily {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	byName := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+// labelValue returns the value of the label name of metric
+func labelValue(metric *dto.Metric, name string) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestMetrics(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 1})
+	defer cleanup()
+	registry := prometheus.NewRegistry()
+	assert.NoError(t, d.RegisterMetrics(registry))
+
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+	for _, uri := range []string{"config-1.tar.gz", "config-2.tar.gz", "config-2.tar.gz", "config-9.tar.gz"} {
+		postForm(d.HandlerDownload, url.Values{"uri": {uri}, "unarchive": {"true"}})
+	}
+
+	families := gather(t, registry)
+	downloads := map[string]float64{}
+	for _, metric := range families["akouste_downloader_downloads_total"].GetMetric() {
+		downloads[labelValue(metric, "result")] = metric.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{resultSuccess: 2, resultNotModified: 1, resultFailure: 1}, downloads)
+
+	duration := families["akouste_downloader_storage_download_duration_seconds"].GetMetric()[0]
+	assert.Equal(t, d.storage.Name(), labelValue(duration, "provider"))
+	assert.Equal(t, uint64(2), duration.GetHistogram().GetSampleCount())
+	var archiveBytes int64
+	for _, name := range []string{"config-1.tar.gz", "config-2.tar.gz"} {
+		info, err := os.Stat(filepath.Join(bucket, name))
+		assert.NoError(t, err)
+		archiveBytes += info.Size()
+	}
+	downloaded := families["akouste_downloader_downloaded_bytes_total"].GetMetric()[0]
+	assert.Equal(t, float64(archiveBytes), downloaded.GetCounter().GetValue())
+	assert.Equal(t, uint64(2), families["akouste_downloader_unarchive_duration_seconds"].GetMetric()[0].GetHistogram().GetSampleCount())
+	assert.Equal(t, float64(1), families["akouste_downloader_retention_deletions_total"].GetMetric()[0].GetCounter().GetValue())
+
+	active := families["akouste_downloader_active_version_info"].GetMetric()[0]
+	assert.Equal(t, "config-2", labelValue(active, "version"))
+	assert.Equal(t, "config-2.tar.gz", labelValue(active, "uri"))
+	assert.Equal(t, d.versions["config-2"].Checksum, labelValue(active, "checksum"))
+	size, err := diskUsage(d.config.DestPath)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(size), families["akouste_downloader_dest_path_bytes"].GetMetric()[0].GetGauge().GetValue())
+
+	// A downloader registers its metrics once
+	assert.Error(t, d.RegisterMetrics(registry))
+}
@@ -0,0 +1,34 @@
+package downloader
+
+import (
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/webhook"
+)
+
+// notify sends event to the webhooks, when configured
+func (d *Downloader) notify(event webhook.Event) {
+	if d.config.Webhook == nil {
+		return
+	}
+	d.config.Webhook.Notify(event)
+}
+
+// notifyFailure sends the failure of the download of uri started at start,
+// result is the partial result of the download when known
+func (d *Downloader) notifyFailure(uri string, result *DownloadResult, start time.Time, err error) {
+	_, code := errorStatus(err)
+	event := webhook.Event{
+		Type:      webhook.EventFailure,
+		URI:       uri,
+		Duration:  time.Since(start),
+		Error:     err.Error(),
+		ErrorCode: code,
+	}
+	if result != nil {
+		event.Version = result.Version
+		event.Dir = result.Dir
+		event.Checksum = result.Checksum
+	}
+	d.notify(event)
+}
@@ -0,0 +1,72 @@
+package downloader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	events := []webhook.Event{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	notifier := webhook.New(webhook.Config{URLs: []string{server.URL}, Backoff: time.Millisecond})
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 1, Webhook: notifier})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-2.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	// Not modified downloads are not notified
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-2.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, "not modified\n", rr.Body.String())
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-9.tar.gz"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	notifier.Close()
+
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{
+		webhook.EventDownload, webhook.EventExtract,
+		webhook.EventDownload, webhook.EventExtract, webhook.EventPrune,
+		webhook.EventFailure,
+	}, types)
+
+	download := events[0]
+	assert.Equal(t, "config-1.tar.gz", download.URI)
+	assert.Equal(t, filepath.Join(d.config.DestPath, "config-1.tar.gz"), download.Dir)
+	assert.True(t, strings.HasPrefix(download.Checksum, ChecksumSHA256+":"))
+	extract := events[3]
+	assert.Equal(t, "config-2", extract.Version)
+	assert.Equal(t, filepath.Join(d.config.DestPath, "config-2"), extract.Dir)
+	assert.Equal(t, d.versions["config-2"].Checksum, extract.Checksum)
+	prune := events[4]
+	assert.Equal(t, "config-1", prune.Version)
+	assert.Equal(t, "config-1.tar.gz", prune.URI)
+	failure := events[5]
+	assert.Equal(t, "config-9.tar.gz", failure.URI)
+	assert.Equal(t, CodeDownloadFailed, failure.ErrorCode)
+	assert.NotEmpty(t, failure.Error)
+}
@@ -0,0 +1,106 @@
+package downloader
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/albertwidi/akouste/pkg/log"
+)
+
+// Error codes of the JSON error responses
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeInvalidURI         = "invalid_uri"
+	CodeInvalidChecksum    = "invalid_checksum"
+	CodeDownloadFailed     = "download_failed"
+	CodeChecksumMismatch   = "checksum_mismatch"
+	CodeSignatureMissing   = "signature_missing"
+	CodeSignatureInvalid   = "signature_invalid"
+	CodeUnsafeArchive      = "unsafe_archive"
+	CodeUnsupportedArchive = "unsupported_archive"
+	CodeInvalidVersion     = "invalid_version"
+	CodeVersionNotFound    = "version_not_found"
+	CodeVersionActive      = "version_active"
+	CodeNoPreviousVersion  = "no_previous_version"
+	CodeJobNotFound        = "job_not_found"
+	CodeHookFailed         = "hook_failed"
+	CodeShuttingDown       = "shutting_down"
+	CodeSyncConflict       = "sync_conflict"
+	CodeInternal           = "internal_error"
+)
+
+// downloadError is an error of the download process along with its HTTP status
+// and machine-readable code
+type downloadError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *downloadError) Error() string {
+	return e.err.Error()
+}
+
+// errorResponse is the JSON body of error responses
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorStatus returns the HTTP status and code of err
+func errorStatus(err error) (int, string) {
+	if derr, ok := err.(*downloadError); ok {
+		return derr.status, derr.code
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+// isJSON returns true if the request body is JSON encoded
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// wantsJSON returns true if the response to r should be JSON encoded,
+// form requests keep their plain text responses unless JSON is accepted
+func wantsJSON(r *http.Request) bool {
+	return isJSON(r) || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeJSON writes v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("error encoding response: %s", err.Error())
+	}
+}
+
+// writeDownloadError writes err to w, internal errors are logged instead of exposed
+func writeDownloadError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+	msg := err.Error()
+	if status >= http.StatusInternalServerError {
+		log.Warnf("%s", err.Error())
+	}
+	if code == CodeInternal {
+		msg = http.StatusText(status)
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, status, errorResponse{Error: errorBody{Code: code, Message: msg}})
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// writeRequestError writes a client error with the given code
+func writeRequestError(w http.ResponseWriter, r *http.Request, status int, code string, err error) {
+	writeDownloadError(w, r, &downloadError{status: status, code: code, err: err})
+}
@@ -0,0 +1,159 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// postJSON sends body as JSON to handler and returns the recorded response
+func postJSON(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	return rr
+}
+
+// decodeError returns the error object of a JSON error response
+func decodeError(t *testing.T, rr *httptest.ResponseRecorder) errorBody {
+	var resp errorResponse
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	return resp.Error
+}
+
+func TestHandlerDownloadJSON(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	err := ioutil.WriteFile(filepath.Join(bucket, "testfile.txt"), []byte("hello"), 0644)
+	assert.NoError(t, err)
+
+	rr := postJSON(d.HandlerDownload, `{"uri":"testfile.txt","sha256":"`+sha256Hex("hello")+`"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var result DownloadResult
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Equal(t, "testfile.txt", result.URI)
+	assert.Equal(t, filepath.Join(d.config.DestPath, "testfile.txt"), result.Path)
+	assert.Equal(t, int64(5), result.Bytes)
+	assert.Equal(t, "sha256:"+sha256Hex("hello"), result.Checksum)
+	assert.Empty(t, result.Dir)
+
+	rr = postJSON(d.HandlerDownload, `{"uri":"config-1.tar.gz","unarchive":true}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	result = DownloadResult{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Equal(t, "config-1", result.Version)
+	assert.Equal(t, filepath.Join(d.config.DestPath, "config-1"), result.Dir)
+	assert.FileExists(t, filepath.Join(result.Dir, "test1.yaml"))
+	info, err := os.Stat(filepath.Join("..", "test", "local-bucket", "config-1.tar.gz"))
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), result.Bytes)
+}
+
+func TestHandlerDownloadJSONErrors(t *testing.T) {
+	d, _, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+
+	tests := []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"uri":`, http.StatusBadRequest, CodeInvalidRequest},
+		{`{}`, http.StatusBadRequest, CodeInvalidRequest},
+		{`{"uri":"dir/"}`, http.StatusBadRequest, CodeInvalidURI},
+		{`{"uri":"testfile.txt","sha256":"abc"}`, http.StatusBadRequest, CodeInvalidChecksum},
+		{`{"uri":"does-not-exist.txt"}`, http.StatusBadRequest, CodeDownloadFailed},
+	}
+	for _, test := range tests {
+		rr := postJSON(d.HandlerDownload, test.body)
+		assert.Equal(t, test.status, rr.Code, test.body)
+		errBody := decodeError(t, rr)
+		assert.Equal(t, test.code, errBody.Code, test.body)
+		assert.NotEmpty(t, errBody.Message, test.body)
+	}
+}
+
+func TestHandlerDownloadAcceptJSON(t *testing.T) {
+	d, _, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+
+	form := url.Values{"uri": {"does-not-exist.txt"}}
+	request := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	d.HandlerDownload(rr, request)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, CodeDownloadFailed, decodeError(t, rr).Code)
+
+	// Form requests without Accept keep the plain text responses
+	rr = postForm(d.HandlerDownload, form)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.True(t, strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain"))
+}
+
+func TestHandlerRollbackJSON(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+
+	for _, uri := range []string{"config-1.tar.gz", "config-2.tar.gz"} {
+		rr := postJSON(d.HandlerDownload, `{"uri":"`+uri+`","unarchive":true}`)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	rr := postJSON(d.HandlerRollback, `{"version":"config-2"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeVersionActive, decodeError(t, rr).Code)
+
+	rr = postJSON(d.HandlerRollback, `{}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body rollbackBody
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "config-1", body.Version)
+}
+
+func TestWriteDownloadError(t *testing.T) {
+	tests := []struct {
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{&downloadError{status: http.StatusBadGateway, code: CodeHookFailed, err: errors.New("hook reload: exit status 1")},
+			http.StatusBadGateway, CodeHookFailed, "hook reload: exit status 1"},
+		{&downloadError{status: http.StatusBadGateway, code: CodeDownloadFailed, err: errors.New("incomplete download of config-1.tar.gz")},
+			http.StatusBadGateway, CodeDownloadFailed, "incomplete download of config-1.tar.gz"},
+		// Internal errors are not exposed
+		{&downloadError{status: http.StatusInternalServerError, code: CodeInternal, err: errors.New("write file error: /data")},
+			http.StatusInternalServerError, CodeInternal, http.StatusText(http.StatusInternalServerError)},
+		{errors.New("open /data: permission denied"),
+			http.StatusInternalServerError, CodeInternal, http.StatusText(http.StatusInternalServerError)},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/", nil)
+		request.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		writeDownloadError(rr, request, test.err)
+
+		assert.Equal(t, test.status, rr.Code, test.message)
+		errBody := decodeError(t, rr)
+		assert.Equal(t, test.code, errBody.Code, test.message)
+		assert.Equal(t, test.message, errBody.Message)
+	}
+}
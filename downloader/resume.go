@@ -0,0 +1,192 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/log"
+	"github.com/albertwidi/akouste/pkg/storage"
+)
+
+// maxResumeAttempts is the number of times an interrupted transfer is resumed
+// before the download fails
+const maxResumeAttempts = 5
+
+// resumeDelay is the wait before the first resume, doubled on every attempt
+var resumeDelay = time.Second
+
+// transferPartial downloads object into partialFile, resuming from the bytes already in
+// partialFile and, after read errors, from the last byte written. Every byte of the file
+// is written to h, the transferred ones to job. It fails unless partialFile ends up
+// with the size of the object.
+func (d *Downloader) transferPartial(ctx context.Context, object storage.Object, partialFile string, h io.Writer, job *Job) error {
+	offset, err := d.resumeOffset(partialFile, object, h)
+	if err != nil {
+		return &downloadError{
+			status: http.StatusInternalServerError,
+			code:   CodeInternal,
+			err:    fmt.Errorf("write file error: %s", err.Error()),
+		}
+	}
+
+	if object.Size == 0 {
+		// Nothing to transfer, range reads of empty objects fail with some providers
+		if err := ioutil.WriteFile(partialFile, nil, 0755); err != nil {
+			return &downloadError{
+				status: http.StatusInternalServerError,
+				code:   CodeInternal,
+				err:    fmt.Errorf("write file error: %s", err.Error()),
+			}
+		}
+	}
+
+	w := io.MultiWriter(job, h)
+	delay := resumeDelay
+	for attempt := 0; offset < object.Size; attempt++ {
+		if attempt > 0 {
+			log.Warnf("resuming download of %s at byte %d/%d: %s", object.Key, offset, object.Size, err.Error())
+			select {
+			case <-ctx.Done():
+				d.keepPartial(partialFile, object)
+				return &downloadError{
+					status: http.StatusBadRequest,
+					code:   CodeDownloadFailed,
+					err:    fmt.Errorf("error downloading %s: %s", object.Key, ctx.Err().Error()),
+				}
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+
+		var n int64
+		var readErr bool
+		n, readErr, err = d.transferRange(ctx, object.Key, partialFile, offset, w)
+		offset += n
+		d.metrics.downloadedBytes.WithLabelValues(d.storage.Name()).Add(float64(n))
+		if err == nil {
+			break
+		}
+		if !readErr {
+			os.Remove(partialFile)
+			return &downloadError{
+				status: http.StatusInternalServerError,
+				code:   CodeInternal,
+				err:    fmt.Errorf("write file error: %s", err.Error()),
+			}
+		}
+		if attempt >= maxResumeAttempts || storage.IsNotExist(err) || ctx.Err() != nil {
+			d.keepPartial(partialFile, object)
+			return &downloadError{
+				status: http.StatusBadRequest,
+				code:   CodeDownloadFailed,
+				err:    fmt.Errorf("error downloading %s: %s", object.Key, err.Error()),
+			}
+		}
+	}
+
+	// The object may have been replaced while it was downloaded
+	info, err := os.Stat(partialFile)
+	if err == nil && info.Size() != object.Size {
+		err = fmt.Errorf("got %d bytes, expected %d", info.Size(), object.Size)
+	}
+	if err != nil {
+		os.Remove(partialFile)
+		return &downloadError{
+			status: http.StatusBadGateway,
+			code:   CodeDownloadFailed,
+			err:    fmt.Errorf("incomplete download of %s: %s", object.Key, err.Error()),
+		}
+	}
+	return nil
+}
+
+// transferRange appends the object at key from offset to file. It returns the number
+// of bytes written and whether the error, if any, came from reading the object.
+func (d *Downloader) transferRange(ctx context.Context, key, file string, offset int64, w io.Writer) (int64, bool, error) {
+	reader, err := d.storage.DownloadRange(ctx, key, offset)
+	if err != nil {
+		return 0, true, err
+	}
+	defer reader.Close()
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(file, flag, 0755)
+	if err != nil {
+		return 0, false, err
+	}
+
+	src := &readRecorder{r: reader}
+	n, err := io.Copy(f, io.TeeReader(src, w))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err != nil && src.err != nil, err
+}
+
+// resumeOffset returns the number of bytes of partialFile which can be resumed,
+// after writing them to w. A partial file left by another object is removed.
+func (d *Downloader) resumeOffset(partialFile string, object storage.Object, w io.Writer) (int64, error) {
+	d.mu.Lock()
+	recorded, ok := d.partials[partialFile]
+	delete(d.partials, partialFile)
+	d.mu.Unlock()
+
+	info, err := os.Stat(partialFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil || !ok || !sameObject(recorded, object) || info.Size() > object.Size {
+		if err := os.Remove(partialFile); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, nil
+	}
+
+	// Feed the bytes already downloaded to the checksum
+	f, err := os.Open(partialFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Infof("resuming download of %s at byte %d/%d", object.Key, n, object.Size)
+	return n, nil
+}
+
+// keepPartial remembers the object partialFile is downloaded from, so the next
+// download of the same object resumes it
+func (d *Downloader) keepPartial(partialFile string, object storage.Object) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.partials == nil {
+		d.partials = make(map[string]storage.Object)
+	}
+	d.partials[partialFile] = object
+	d.persist()
+}
+
+// readRecorder remembers the read errors of r, to tell them from write errors
+type readRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
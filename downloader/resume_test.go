@@ -0,0 +1,117 @@
+package downloader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadResume(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	testcontent := "hello, world"
+	err := ioutil.WriteFile(filepath.Join(bucket, "testfile.txt"), []byte(testcontent), 0644)
+	assert.NoError(t, err)
+	object, err := d.storage.Attributes(context.TODO(), "testfile.txt")
+	assert.NoError(t, err)
+	partialFile := filepath.Join(d.config.DestPath, ".testfile.txt"+partialExtension)
+	checksum, err := newChecksum(ChecksumSHA256, sha256Hex(testcontent))
+	assert.NoError(t, err)
+	req := downloadRequest{URI: "testfile.txt", Checksum: checksum, Force: true}
+
+	tests := []struct {
+		name        string
+		partial     string
+		recorded    bool
+		transferred int64
+	}{
+		{"resumed", "hello", true, 7},
+		{"complete", testcontent, true, 0},
+		{"not recorded", "hello", false, 12},
+		{"larger than the object", testcontent + "!", true, 12},
+	}
+	for _, test := range tests {
+		err = ioutil.WriteFile(partialFile, []byte(test.partial), 0644)
+		assert.NoError(t, err)
+		if test.recorded {
+			d.keepPartial(partialFile, object)
+		}
+
+		job := newJob(req.URI)
+		_, err = d.download(context.TODO(), req, job)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.transferred, job.BytesTransferred, test.name)
+
+		content, err := ioutil.ReadFile(filepath.Join(d.config.DestPath, "testfile.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, testcontent, string(content), test.name)
+		_, err = os.Stat(partialFile)
+		assert.True(t, os.IsNotExist(err), test.name)
+	}
+}
+
+func TestDownloadResumeChangedObject(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	err := ioutil.WriteFile(filepath.Join(bucket, "testfile.txt"), []byte("hello, world"), 0644)
+	assert.NoError(t, err)
+	object, err := d.storage.Attributes(context.TODO(), "testfile.txt")
+	assert.NoError(t, err)
+
+	// The partial file was left by the previous content of the object
+	partialFile := filepath.Join(d.config.DestPath, ".testfile.txt"+partialExtension)
+	err = ioutil.WriteFile(partialFile, []byte("hello"), 0644)
+	assert.NoError(t, err)
+	d.keepPartial(partialFile, object)
+	err = ioutil.WriteFile(filepath.Join(bucket, "testfile.txt"), []byte("HELLO, WORLD!"), 0644)
+	assert.NoError(t, err)
+
+	job := newJob("testfile.txt")
+	_, err = d.download(context.TODO(), downloadRequest{URI: "testfile.txt"}, job)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(13), job.BytesTransferred)
+	content, err := ioutil.ReadFile(filepath.Join(d.config.DestPath, "testfile.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "HELLO, WORLD!", string(content))
+}
+
+func TestDownloadEmptyObject(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	err := ioutil.WriteFile(filepath.Join(bucket, "empty.txt"), nil, 0644)
+	assert.NoError(t, err)
+
+	result, err := d.download(context.TODO(), downloadRequest{URI: "empty.txt"}, newJob("empty.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), result.Bytes)
+	assert.FileExists(t, filepath.Join(d.config.DestPath, "empty.txt"))
+}
+
+func TestDownloadOverwritesLongerFile(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	object := filepath.Join(bucket, "testfile.txt")
+	destinationFile := filepath.Join(d.config.DestPath, "testfile.txt")
+	partialFile := filepath.Join(d.config.DestPath, ".testfile.txt"+partialExtension)
+
+	err := ioutil.WriteFile(object, []byte("hello, world"), 0644)
+	assert.NoError(t, err)
+	_, err = d.download(context.TODO(), downloadRequest{URI: "testfile.txt"}, newJob("testfile.txt"))
+	assert.NoError(t, err)
+
+	// Neither the previous download nor a stale partial file leave bytes behind
+	err = ioutil.WriteFile(object, []byte("bye"), 0644)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(partialFile, []byte("hello, world, stale"), 0644)
+	assert.NoError(t, err)
+	_, err = d.download(context.TODO(), downloadRequest{URI: "testfile.txt", Force: true}, newJob("testfile.txt"))
+	assert.NoError(t, err)
+
+	content, err := ioutil.ReadFile(destinationFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "bye", string(content))
+}
@@ -0,0 +1,164 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/log"
+	"github.com/albertwidi/akouste/pkg/webhook"
+)
+
+// RetentionPolicy selects the versions deleted from DestPath after a download
+type RetentionPolicy interface {
+	// Expired returns the names of the versions the policy deletes.
+	// versions are ordered from the newest to the oldest. The active and pinned versions
+	// are never deleted, whatever the policy returns, but they count toward its limits.
+	Expired(versions []Version, now time.Time) []string
+}
+
+// KeepLast keeps the given number of newest versions, the active and pinned versions
+// take their slots first
+type KeepLast int
+
+// Expired implements RetentionPolicy
+func (p KeepLast) Expired(versions []Version, now time.Time) []string {
+	kept := 0
+	for _, version := range versions {
+		if version.protected() {
+			kept++
+		}
+	}
+
+	expired := []string{}
+	for _, version := range versions {
+		if version.protected() {
+			continue
+		}
+		if kept < int(p) {
+			kept++
+			continue
+		}
+		expired = append(expired, version.Name)
+	}
+	return expired
+}
+
+// KeepWithin keeps the versions downloaded within the given duration
+type KeepWithin time.Duration
+
+// Expired implements RetentionPolicy
+func (p KeepWithin) Expired(versions []Version, now time.Time) []string {
+	expired := []string{}
+	for _, version := range versions {
+		if now.Sub(version.DownloadedAt) > time.Duration(p) {
+			expired = append(expired, version.Name)
+		}
+	}
+	return expired
+}
+
+// MaxTotalSize deletes the oldest versions until the versions take at most the given
+// number of bytes
+type MaxTotalSize int64
+
+// Expired implements RetentionPolicy
+func (p MaxTotalSize) Expired(versions []Version, now time.Time) []string {
+	var total int64
+	for _, version := range versions {
+		total += version.Size
+	}
+
+	expired := []string{}
+	for i := len(versions) - 1; i >= 0 && total > int64(p); i-- {
+		if versions[i].protected() {
+			continue
+		}
+		total -= versions[i].Size
+		expired = append(expired, versions[i].Name)
+	}
+	return expired
+}
+
+// retentionPolicies returns the policies of the configuration,
+// KeepOldCount applies unless it is 0 and other policies are set
+func (c Config) retentionPolicies() []RetentionPolicy {
+	if c.KeepOldCount > 0 || len(c.Retention) == 0 {
+		return append([]RetentionPolicy{KeepLast(c.KeepOldCount)}, c.Retention...)
+	}
+	return c.Retention
+}
+
+// expired returns the versions deleted by any of the retention policies,
+// versions are ordered from the newest to the oldest
+func (d *Downloader) expired(versions []Version, now time.Time) map[string]bool {
+	expired := map[string]bool{}
+	for _, policy := range d.config.retentionPolicies() {
+		for _, name := range policy.Expired(versions, now) {
+			expired[name] = true
+		}
+	}
+
+	for _, version := range versions {
+		if version.protected() {
+			delete(expired, version.Name)
+		}
+	}
+	return expired
+}
+
+// nextForDeletion returns the versions deleted once another version is downloaded and activated
+func (d *Downloader) nextForDeletion(versions []Version, now time.Time) map[string]bool {
+	next := []Version{{DownloadedAt: now, Active: true}}
+	for _, version := range versions {
+		version.Active = false
+		next = append(next, version)
+	}
+	return d.expired(next, now)
+}
+
+// prune deletes the versions expired by the retention policies once no version is being extracted
+func (d *Downloader) prune() {
+	d.extractMu.Lock()
+	defer d.extractMu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	retained, err := d.retainedVersions()
+	if err != nil {
+		log.Warnf("error listing versions: %s", err.Error())
+		return
+	}
+	// Files still being downloaded or waiting to be extracted are not versions yet,
+	// the versions being downloaded again count but are not deleted
+	versions := []Version{}
+	for _, version := range retained {
+		_, recorded := d.versions[version.Name]
+		if recorded || !d.destinations.locked(version.Name) {
+			versions = append(versions, version)
+		}
+	}
+
+	for name := range d.expired(versions, time.Now()) {
+		if d.destinations.locked(name) {
+			continue
+		}
+		log.Infof("deleting version %s", name)
+		start := time.Now()
+		dir := filepath.Join(d.config.DestPath, name)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("error delete: %s", err.Error())
+			continue
+		}
+
+		event := webhook.Event{Type: webhook.EventPrune, Version: name, Dir: dir, Duration: time.Since(start)}
+		if version, ok := d.versions[name]; ok {
+			event.URI = version.URI
+			event.Checksum = version.Checksum
+		}
+		d.notify(event)
+		d.metrics.retentionDeletions.Inc()
+		delete(d.versions, name)
+	}
+	d.persist()
+}
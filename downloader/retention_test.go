@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testVersions returns versions v4 (newest) to v1 downloaded an hour apart, 10 bytes each,
+// v3 is active
+func testVersions(now time.Time) []Version {
+	versions := []Version{}
+	for i := 4; i >= 1; i-- {
+		versions = append(versions, Version{
+			Name:         "v" + string('0'+rune(i)),
+			DownloadedAt: now.Add(-time.Duration(5-i) * time.Hour),
+			Size:         10,
+			Active:       i == 3,
+		})
+	}
+	return versions
+}
+
+func TestRetentionPolicies(t *testing.T) {
+	now := time.Now()
+	versions := testVersions(now)
+
+	// The active version takes one of the slots
+	assert.Equal(t, []string{"v2", "v1"}, KeepLast(2).Expired(versions, now))
+	assert.Equal(t, []string{"v4", "v2", "v1"}, KeepLast(1).Expired(versions, now))
+	assert.Equal(t, []string{"v4", "v2", "v1"}, KeepLast(0).Expired(versions, now))
+	assert.Equal(t, []string{}, KeepLast(10).Expired(versions, now))
+
+	assert.Equal(t, []string{"v2", "v1"}, KeepWithin(150*time.Minute).Expired(versions, now))
+	assert.Equal(t, []string{}, KeepWithin(5*time.Hour).Expired(versions, now))
+
+	// Deletes the oldest first, the active version counts toward the total
+	assert.Equal(t, []string{"v1", "v2"}, MaxTotalSize(20).Expired(versions, now))
+	assert.Equal(t, []string{"v1", "v2", "v4"}, MaxTotalSize(5).Expired(versions, now))
+	assert.Equal(t, []string{}, MaxTotalSize(40).Expired(versions, now))
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	versions := testVersions(now)
+	versions[3].Pinned = true
+
+	tests := []struct {
+		config  Config
+		expired []string
+	}{
+		{Config{KeepOldCount: 3}, []string{"v2"}},
+		{Config{KeepOldCount: 3, Retention: []RetentionPolicy{MaxTotalSize(25)}}, []string{"v2", "v4"}},
+		{Config{Retention: []RetentionPolicy{KeepWithin(90 * time.Minute)}}, []string{"v2"}},
+		{Config{}, []string{"v2", "v4"}},
+	}
+	for _, test := range tests {
+		d := &Downloader{config: test.config}
+		names := []string{}
+		for name := range d.expired(versions, now) {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		assert.Equal(t, test.expired, names, test.config)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	d, _, cleanup := newTestDownloader(t, Config{KeepOldCount: 3, Pinned: []string{"v1"}})
+	defer cleanup()
+
+	// Records give the order, whatever the filesystem timestamps
+	now := time.Now()
+	for i, name := range []string{"v1", "v2", "v3", "v4"} {
+		err := os.Mkdir(filepath.Join(d.config.DestPath, name), 0755)
+		assert.NoError(t, err)
+		d.versions[name] = &Version{Name: name, DownloadedAt: now.Add(time.Duration(i) * time.Hour)}
+	}
+	err := os.Chtimes(filepath.Join(d.config.DestPath, "v4"), now.Add(-time.Hour), now.Add(-time.Hour))
+	assert.NoError(t, err)
+	err = d.activate("v2")
+	assert.NoError(t, err)
+
+	d.prune()
+
+	entries, err := ioutil.ReadDir(d.config.DestPath)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{StateDir, CurrentLink, "v1", "v2", "v4"}, names)
+	assert.NotContains(t, d.versions, "v3")
+}
+
+func TestHandlerDownloadRetention(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+
+	for _, name := range []string{"config-1", "config-2", "config-3"} {
+		copyFixture(t, bucket, name+".tar.gz")
+		rr := postForm(d.HandlerDownload, url.Values{"uri": {name + ".tar.gz"}, "unarchive": {"true"}})
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	entries, err := ioutil.ReadDir(d.config.DestPath)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{StateDir, "config-2", "config-3", CurrentLink}, names)
+}
@@ -0,0 +1,182 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/albertwidi/akouste/pkg/hook"
+	"github.com/albertwidi/akouste/pkg/log"
+)
+
+// Error variables
+var (
+	ErrNoPreviousVersion    = errors.New("no previous version to rollback to")
+	ErrVersionNotFound      = errors.New("version not found")
+	ErrInvalidVersionName   = errors.New("invalid version name")
+	ErrVersionAlreadyActive = errors.New("version is already active")
+)
+
+// Rollback re-activates a version retained in DestPath without touching the bucket.
+// When version is empty the previously active version is re-activated.
+// It returns the name of the activated version, the hooks are run once it is activated.
+func (d *Downloader) Rollback(version string) (string, error) {
+	d.mu.Lock()
+	version, err := d.rollback(version)
+	env := d.hookEnv(hook.EventRollback, version)
+	d.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	d.runHooks(context.Background(), env)
+	return version, nil
+}
+
+// rollback re-activates version, or the previous version when empty, d.mu must be held
+func (d *Downloader) rollback(version string) (string, error) {
+	active, err := d.activeVersion()
+	if err != nil {
+		return "", err
+	}
+
+	previous := version == ""
+	if previous {
+		version = d.previousVersion(active)
+		if version == "" {
+			return "", &downloadError{status: http.StatusConflict, code: CodeNoPreviousVersion, err: ErrNoPreviousVersion}
+		}
+	}
+
+	if err := validateVersionName(version); err != nil {
+		return "", &downloadError{status: http.StatusBadRequest, code: CodeInvalidVersion, err: err}
+	}
+	if _, ok := d.syncs[version]; ok {
+		return "", syncConflict(ErrSyncedDir, version)
+	}
+	if version == active {
+		return "", &downloadError{
+			status: http.StatusConflict,
+			code:   CodeVersionActive,
+			err:    fmt.Errorf("%s: %s", ErrVersionAlreadyActive.Error(), version),
+		}
+	}
+	if !isRetainedVersion(d.config.DestPath, version) {
+		return "", &downloadError{
+			status: http.StatusNotFound,
+			code:   CodeVersionNotFound,
+			err:    fmt.Errorf("%s: %s", ErrVersionNotFound.Error(), version),
+		}
+	}
+
+	if err := d.activate(version); err != nil {
+		return "", err
+	}
+	// Going back to the previous version leaves it on top of the history already
+	if !previous {
+		d.history = append(d.history, version)
+	}
+	d.persist()
+
+	log.Infof("rolled back from %s to %s", active, version)
+	return version, nil
+}
+
+// previousVersion returns the version which was active before active,
+// or an empty string if there is none
+func (d *Downloader) previousVersion(active string) string {
+	// Drop the current and no longer retained versions from the history,
+	// so consecutive rollbacks keep going back
+	for len(d.history) > 0 {
+		last := d.history[len(d.history)-1]
+		if last != active && isRetainedVersion(d.config.DestPath, last) {
+			return last
+		}
+		d.history = d.history[:len(d.history)-1]
+	}
+	return ""
+}
+
+// loadHistory returns the activation history approximated from the versions in dir,
+// ordered from the least to the most recently modified and ending with the active version
+func loadHistory(dir, active string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(left, right int) bool {
+		return entries[left].ModTime().Before(entries[right].ModTime())
+	})
+
+	history := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && isVersionEntry(entry.Name()) && entry.Name() != active {
+			history = append(history, entry.Name())
+		}
+	}
+	if active != "" {
+		history = append(history, active)
+	}
+	return history, nil
+}
+
+// isRetainedVersion returns true if name is a version directory in dir
+func isRetainedVersion(dir, name string) bool {
+	info, err := os.Stat(filepath.Join(dir, name))
+	return err == nil && info.IsDir()
+}
+
+// validateVersionName makes sure name refers to an entry directly inside DestPath
+func validateVersionName(name string) error {
+	if name == "" || !isVersionEntry(name) || strings.ContainsAny(name, `/\`) || name == ".." {
+		return fmt.Errorf("%s: %q", ErrInvalidVersionName.Error(), name)
+	}
+	return nil
+}
+
+// HandlerRollback re-activates a previously downloaded version
+// Accepted POST form fields, or JSON body fields when Content-Type is application/json:
+// - version : name of the version to activate (optional, defaults to the previous version)
+//
+// e.g. curl -X POST -d "version=config-1" localhost:9000/v1/rollback
+func (d *Downloader) HandlerRollback(w http.ResponseWriter, r *http.Request) {
+	var body rollbackBody
+	if isJSON(r) {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&body); err != nil {
+			writeRequestError(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("parse json failed: %s", err.Error()))
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			writeRequestError(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("parse form failed: %s", err.Error()))
+			return
+		}
+		body.Version = r.PostForm.Get("version")
+	}
+
+	version, err := d.Rollback(body.Version)
+	if err != nil {
+		writeDownloadError(w, r, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, rollbackBody{Version: version})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("rolled back to %s\n", version)))
+}
+
+// rollbackBody is the JSON body of rollback requests and responses
+type rollbackBody struct {
+	Version string `json:"version"`
+}
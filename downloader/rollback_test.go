@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/albertwidi/akouste/pkg/storage"
+	"github.com/albertwidi/akouste/pkg/storage/local"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerRollback(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+
+	// Nothing to rollback to yet
+	rr := postForm(d.HandlerRollback, url.Values{})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	for _, name := range []string{"config-1", "config-2", "config-3"} {
+		copyFixture(t, bucket, name+".tar.gz")
+		rr = postForm(d.HandlerDownload, url.Values{"uri": {name + ".tar.gz"}, "unarchive": {"true"}})
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	// The bucket is not needed to rollback
+	assert.NoError(t, os.RemoveAll(bucket))
+
+	rr = postForm(d.HandlerRollback, url.Values{})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "rolled back to config-2\n", rr.Body.String())
+
+	rr = postForm(d.HandlerRollback, url.Values{})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "rolled back to config-1\n", rr.Body.String())
+
+	rr = postForm(d.HandlerRollback, url.Values{})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = postForm(d.HandlerRollback, url.Values{"version": {"config-3"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-3", active)
+
+	rr = postForm(d.HandlerRollback, url.Values{"version": {"config-3"}})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = postForm(d.HandlerRollback, url.Values{"version": {"config-9"}})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = postForm(d.HandlerRollback, url.Values{"version": {"../config-1"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = postForm(d.HandlerRollback, url.Values{"version": {CurrentLink}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestRollbackAfterRestart(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+
+	for _, name := range []string{"config-1", "config-2"} {
+		copyFixture(t, bucket, name+".tar.gz")
+		rr := postForm(d.HandlerDownload, url.Values{"uri": {name + ".tar.gz"}, "unarchive": {"true"}})
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	localProvider, err := local.New(local.Config{Bucket: bucket})
+	assert.NoError(t, err)
+	restarted, err := New(context.TODO(), storage.New(localProvider), d.config)
+	assert.NoError(t, err)
+
+	version, err := restarted.Rollback("")
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", version)
+	target, err := os.Readlink(filepath.Join(d.config.DestPath, CurrentLink))
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", target)
+}
@@ -0,0 +1,135 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/log"
+)
+
+// Error variables
+var (
+	ErrShuttingDown = errors.New("downloader is shutting down")
+)
+
+// cancelWait bounds the wait for the downloads cancelled by Shutdown, extraction cannot be interrupted
+var cancelWait = 5 * time.Second
+
+// begin registers a download in flight, it fails once Shutdown was called.
+// The returned context is also cancelled when Shutdown gives up waiting,
+// done must be called once the download returned.
+func (d *Downloader) begin(ctx context.Context) (context.Context, func(), error) {
+	d.closeMu.Lock()
+	defer d.closeMu.Unlock()
+	if d.closed {
+		return nil, nil, errShuttingDown()
+	}
+	d.inflight.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-d.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		d.inflight.Done()
+	}, nil
+}
+
+// accepting returns an error once Shutdown was called
+func (d *Downloader) accepting() error {
+	d.closeMu.Lock()
+	defer d.closeMu.Unlock()
+	if d.closed {
+		return errShuttingDown()
+	}
+	return nil
+}
+
+func errShuttingDown() error {
+	return &downloadError{
+		status: http.StatusServiceUnavailable,
+		code:   CodeShuttingDown,
+		err:    ErrShuttingDown,
+	}
+}
+
+// Shutdown stops accepting downloads and waits until the downloads in flight, extractions
+// and hooks included, are done or ctx is done. Downloads still in flight are then cancelled,
+// interrupted transfers are kept to be resumed.
+// Unfinished work is removed from DestPath before Shutdown returns, unless downloads are
+// still in flight after being cancelled.
+func (d *Downloader) Shutdown(ctx context.Context) error {
+	d.closeMu.Lock()
+	d.closed = true
+	d.closeMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Warnf("shutdown: cancelling the downloads in flight: %s", err.Error())
+		d.stopOnce.Do(func() { close(d.stopping) })
+		select {
+		case <-drained:
+		case <-time.After(cancelWait):
+			// The extractions still running write to DestPath, New cleans up on the next start
+			log.Warnf("shutdown: downloads still in flight after %s, leaving the cleanup to the next start", cancelWait)
+			return err
+		}
+	}
+
+	d.extractMu.Lock()
+	d.cleanup()
+	d.extractMu.Unlock()
+	return err
+}
+
+// cleanup removes the working entries left in DestPath by unfinished downloads:
+// staging and replaced directories, temporary links and probe files, and partial files which cannot be resumed
+func (d *Downloader) cleanup() {
+	entries, err := ioutil.ReadDir(d.config.DestPath)
+	if err != nil {
+		log.Warnf("error cleaning up %s: %s", d.config.DestPath, err.Error())
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, entry := range entries {
+		name := entry.Name()
+		entryPath := filepath.Join(d.config.DestPath, name)
+		switch {
+		case strings.HasPrefix(name, stagingPrefix), strings.HasPrefix(name, oldPrefix), strings.HasPrefix(name, linkPrefix),
+			strings.HasPrefix(name, probePrefix):
+		case strings.HasPrefix(name, ".") && strings.HasSuffix(name, partialExtension):
+			if _, ok := d.partials[entryPath]; ok {
+				continue
+			}
+		default:
+			continue
+		}
+
+		log.Infof("removing unfinished %s", entryPath)
+		if err := os.RemoveAll(entryPath); err != nil {
+			log.Warnf("error delete: %s", err.Error())
+		}
+	}
+}
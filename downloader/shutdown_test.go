@@ -0,0 +1,173 @@
+package downloader
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/hook"
+	"github.com/albertwidi/akouste/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingHook blocks the downloads running it until released or cancelled
+type blockingHook struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingHook() *blockingHook {
+	return &blockingHook{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (h *blockingHook) String() string {
+	return "blocking"
+}
+
+func (h *blockingHook) Run(ctx context.Context, env hook.Env) hook.Result {
+	h.started <- struct{}{}
+	select {
+	case <-h.release:
+		return hook.Result{Hook: h.String()}
+	case <-ctx.Done():
+		return hook.Result{Hook: h.String(), ExitStatus: -1, Error: ctx.Err().Error()}
+	}
+}
+
+// stubbornHook ignores the cancellation, like an extraction
+type stubbornHook struct {
+	*blockingHook
+}
+
+func (h *stubbornHook) Run(ctx context.Context, env hook.Env) hook.Result {
+	h.started <- struct{}{}
+	<-h.release
+	return hook.Result{Hook: h.String()}
+}
+
+func TestShutdown(t *testing.T) {
+	h := newBlockingHook()
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2, Hooks: []hook.Hook{h}})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}, "async": {"true"}})
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	<-h.started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- d.Shutdown(context.Background())
+	}()
+
+	// New downloads are rejected while the download in flight is drained
+	for rr.Code != http.StatusServiceUnavailable {
+		time.Sleep(10 * time.Millisecond)
+		rr = postJSON(d.HandlerDownload, `{"uri":"config-1.tar.gz","unarchive":true}`)
+	}
+	assert.Equal(t, CodeShuttingDown, decodeError(t, rr).Code)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before the download was done")
+	default:
+	}
+
+	close(h.release)
+	assert.NoError(t, <-shutdown)
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", active)
+
+	_, err = d.download(context.Background(), downloadRequest{URI: "config-1.tar.gz"}, newJob("config-1.tar.gz"))
+	assert.Equal(t, ErrShuttingDown, err.(*downloadError).err)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	h := newBlockingHook()
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2, Hooks: []hook.Hook{h}})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+
+	result := make(chan *DownloadResult)
+	go func() {
+		req := downloadRequest{URI: "config-1.tar.gz", Unarchive: true}
+		r, _ := d.download(context.Background(), req, newJob(req.URI))
+		result <- r
+	}()
+	<-h.started
+
+	// Leftovers of unfinished downloads
+	staging := filepath.Join(d.config.DestPath, stagingPrefix+"config-2-123")
+	assert.NoError(t, os.Mkdir(staging, 0755))
+	partial := filepath.Join(d.config.DestPath, ".config-3.tar.gz"+partialExtension)
+	assert.NoError(t, ioutil.WriteFile(partial, []byte("conf"), 0644))
+	resumable := filepath.Join(d.config.DestPath, ".config-4.tar.gz"+partialExtension)
+	assert.NoError(t, ioutil.WriteFile(resumable, []byte("conf"), 0644))
+	d.keepPartial(resumable, storage.Object{Key: "config-4.tar.gz", Size: 10})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, d.Shutdown(ctx))
+
+	// The hook was cancelled
+	r := <-result
+	assert.Equal(t, context.Canceled.Error(), r.Hooks[0].Error)
+	assert.False(t, pathExists(staging))
+	assert.False(t, pathExists(partial))
+	assert.True(t, pathExists(resumable))
+}
+
+func TestShutdownStillInFlight(t *testing.T) {
+	defer func(wait time.Duration) { cancelWait = wait }(cancelWait)
+	cancelWait = 10 * time.Millisecond
+
+	h := &stubbornHook{newBlockingHook()}
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2, Hooks: []hook.Hook{h}})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+
+	done := make(chan struct{})
+	go func() {
+		req := downloadRequest{URI: "config-1.tar.gz", Unarchive: true}
+		d.download(context.Background(), req, newJob(req.URI))
+		close(done)
+	}()
+	<-h.started
+
+	staging := filepath.Join(d.config.DestPath, stagingPrefix+"config-2-123")
+	assert.NoError(t, os.Mkdir(staging, 0755))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, d.Shutdown(ctx))
+
+	// DestPath is left to the cleanup of the next start
+	assert.True(t, pathExists(staging))
+	close(h.release)
+	<-done
+	restart(t, d, bucket)
+	assert.False(t, pathExists(staging))
+}
+
+func TestNewCleanup(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+
+	for _, name := range []string{stagingPrefix + "config-1-123", oldPrefix + "config-1-456"} {
+		assert.NoError(t, os.Mkdir(filepath.Join(d.config.DestPath, name), 0755))
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(d.config.DestPath, ".config-1.tar.gz"+partialExtension), []byte("conf"), 0644))
+
+	restart(t, d, bucket)
+	assertEmptyDir(t, d.config.DestPath)
+}
+
+func pathExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
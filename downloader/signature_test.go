@@ -0,0 +1,68 @@
+package downloader
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/albertwidi/akouste/pkg/signature"
+	"github.com/albertwidi/akouste/pkg/storage"
+	"github.com/albertwidi/akouste/pkg/storage/local"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerDownloadSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	d, bucket, cleanup := newTestDownloader(t, Config{
+		KeepOldCount: 2,
+		TrustedKeys:  []signature.PublicKey{{Key: pub}},
+	})
+	defer cleanup()
+
+	localProvider, err := local.New(local.Config{Bucket: bucket})
+	assert.NoError(t, err)
+	publisher := storage.New(localProvider)
+	source := filepath.Join("..", "test", "local-bucket", "config-1.tar.gz")
+
+	// Unsigned artifacts are refused
+	copyFixture(t, bucket, "config-1.tar.gz")
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrSignatureMissing.Error())
+	assertEmptyDir(t, d.config.DestPath)
+
+	// Artifacts signed by an untrusted key are refused
+	_, err = publisher.UploadFileSigned(context.TODO(), source, "config-1.tar.gz", otherPriv)
+	assert.NoError(t, err)
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), signature.ErrInvalidSignature.Error())
+	assertEmptyDir(t, d.config.DestPath)
+
+	_, err = publisher.UploadFileSigned(context.TODO(), source, "config-1.tar.gz", priv)
+	assert.NoError(t, err)
+	rr = postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.FileExists(t, filepath.Join(d.config.DestPath, CurrentLink, "test1.yaml"))
+}
+
+// assertEmptyDir asserts dir has no entries
+func assertEmptyDir(t *testing.T, dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Name() != StateDir {
+			names = append(names, entry.Name())
+		}
+	}
+	assert.Empty(t, names)
+}
@@ -0,0 +1,197 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/log"
+	"github.com/albertwidi/akouste/pkg/storage"
+)
+
+// StateDir is the hidden directory of DestPath holding the downloader state
+const StateDir = ".akouste"
+
+// stateFile is the name of the state file in StateDir
+const stateFile = "state.json"
+
+// stateVersion is the format version of the state file
+const stateVersion = 1
+
+// state is what the downloader records about DestPath, persisted in StateDir
+type state struct {
+	Version int `json:"version"`
+	// Records of the downloaded versions, by name
+	Versions map[string]*Version `json:"versions"`
+	// Objects the versions were downloaded from, by uri
+	Sources map[string]source `json:"sources"`
+	// Activated versions, from the oldest to the current one
+	History []string `json:"history"`
+	// Objects of the interrupted downloads which can be resumed, by partial file name
+	Partials map[string]storage.Object `json:"partials,omitempty"`
+	// Directories mirroring a bucket prefix, by name
+	Syncs map[string]*syncRecord `json:"syncs,omitempty"`
+}
+
+// statePath returns the path of the state file
+func (d *Downloader) statePath() string {
+	return filepath.Join(d.config.DestPath, StateDir, stateFile)
+}
+
+// loadState restores the records of the previous runs from the state file.
+// A missing state file is rebuilt from DestPath, a corrupt one is moved aside then rebuilt.
+func (d *Downloader) loadState() error {
+	content, err := ioutil.ReadFile(d.statePath())
+	if os.IsNotExist(err) {
+		return d.rebuildState()
+	}
+	if err != nil {
+		return err
+	}
+
+	var s state
+	if err := json.Unmarshal(content, &s); err != nil || s.Version != stateVersion {
+		if err == nil {
+			err = fmt.Errorf("unsupported version %d", s.Version)
+		}
+		corrupt := fmt.Sprintf("%s.corrupt-%d", d.statePath(), time.Now().Unix())
+		log.Warnf("error reading state file %s, moved to %s and rebuilt: %s", d.statePath(), corrupt, err.Error())
+		if err := os.Rename(d.statePath(), corrupt); err != nil {
+			return err
+		}
+		return d.rebuildState()
+	}
+
+	// Forget about the versions deleted while the downloader was stopped
+	for name := range s.Versions {
+		if _, err := os.Lstat(filepath.Join(d.config.DestPath, name)); err != nil || !isVersionEntry(name) {
+			delete(s.Versions, name)
+		}
+	}
+	for uri, src := range s.Sources {
+		if _, ok := s.Versions[src.Version]; !ok {
+			delete(s.Sources, uri)
+		}
+	}
+	if d.partials == nil {
+		d.partials = make(map[string]storage.Object)
+	}
+	for name, object := range s.Partials {
+		if filepath.Base(name) != name {
+			continue
+		}
+		d.partials[filepath.Join(d.config.DestPath, name)] = object
+	}
+	for name, version := range s.Versions {
+		d.versions[name] = version
+	}
+	for uri, src := range s.Sources {
+		d.sources[uri] = src
+	}
+	for name, record := range s.Syncs {
+		if _, err := os.Stat(filepath.Join(d.config.DestPath, name)); err == nil && isVersionEntry(name) {
+			d.syncs[name] = record
+		}
+	}
+	d.history = s.History
+
+	// The current link may have been changed by hand
+	active, err := d.activeVersion()
+	if err != nil {
+		return err
+	}
+	if active != "" && (len(d.history) == 0 || d.history[len(d.history)-1] != active) {
+		d.history = append(d.history, active)
+	}
+	return nil
+}
+
+// rebuildState records the versions found in DestPath, dated by their modification time,
+// and writes the state file
+func (d *Downloader) rebuildState() error {
+	active, err := d.activeVersion()
+	if err != nil {
+		return err
+	}
+	d.history, err = loadHistory(d.config.DestPath, active)
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(d.config.DestPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if isVersionEntry(entry.Name()) {
+			d.versions[entry.Name()] = &Version{
+				Name:         entry.Name(),
+				DownloadedAt: entry.ModTime(),
+			}
+		}
+	}
+	return d.saveState()
+}
+
+// saveState atomically writes the state file, d.mu must be held
+func (d *Downloader) saveState() error {
+	s := state{
+		Version:  stateVersion,
+		Versions: d.versions,
+		Sources:  d.sources,
+		History:  d.history,
+		Partials: make(map[string]storage.Object),
+		Syncs:    d.syncs,
+	}
+	for path, object := range d.partials {
+		s.Partials[filepath.Base(path)] = object
+	}
+
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.statePath()), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(d.statePath(), content)
+}
+
+// persist saves the state file, failures are logged as the downloads themselves succeeded,
+// d.mu must be held
+func (d *Downloader) persist() {
+	if err := d.saveState(); err != nil {
+		log.Warnf("error writing state file: %s", err.Error())
+	}
+}
+
+// writeFileAtomic writes content to a temporary file renamed over filename,
+// readers see either the previous or the new content
+func writeFileAtomic(filename string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+"-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package downloader
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/albertwidi/akouste/pkg/storage"
+	"github.com/albertwidi/akouste/pkg/storage/local"
+	"github.com/stretchr/testify/assert"
+)
+
+// restart returns a new downloader using the same bucket and configuration as d
+func restart(t *testing.T, d *Downloader, bucket string) *Downloader {
+	localProvider, err := local.New(local.Config{Bucket: bucket})
+	assert.NoError(t, err)
+	restarted, err := New(context.TODO(), storage.New(localProvider), d.config)
+	assert.NoError(t, err)
+	return restarted
+}
+
+func TestStatePersisted(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+	for _, name := range []string{"config-1", "config-2", "config-3"} {
+		copyFixture(t, bucket, name+".tar.gz")
+		rr := postForm(d.HandlerDownload, url.Values{"uri": {name + ".tar.gz"}, "unarchive": {"true"}})
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+	_, err := d.Rollback("config-1")
+	assert.NoError(t, err)
+	// Deleted while the downloader is stopped
+	assert.NoError(t, os.RemoveAll(filepath.Join(d.config.DestPath, "config-3")))
+
+	restarted := restart(t, d, bucket)
+	versions, err := restarted.Versions()
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	for _, version := range versions {
+		assert.Equal(t, version.Name+".tar.gz", version.URI)
+		assert.Equal(t, bucket, version.Bucket)
+		assert.True(t, strings.HasPrefix(version.Checksum, ChecksumSHA256+":"))
+	}
+	assert.NotContains(t, restarted.versions, "config-3")
+	assert.NotContains(t, restarted.sources, "config-3.tar.gz")
+
+	// The history survives, going back from config-1 to config-2
+	version, err := restarted.Rollback("")
+	assert.NoError(t, err)
+	assert.Equal(t, "config-2", version)
+
+	// Unchanged objects are not downloaded again after a restart
+	rr := postForm(restarted.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, "not modified\n", rr.Body.String())
+}
+
+func TestStateCorrupt(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	err := ioutil.WriteFile(d.statePath(), []byte(`{"version":1,"versions":`), 0644)
+	assert.NoError(t, err)
+
+	restarted := restart(t, d, bucket)
+	assert.Contains(t, restarted.versions, "config-1")
+	assert.Empty(t, restarted.versions["config-1"].URI)
+	assert.Equal(t, []string{"config-1"}, restarted.history)
+
+	// The corrupt file is kept aside and a valid one is written
+	entries, err := ioutil.ReadDir(filepath.Join(d.config.DestPath, StateDir))
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Len(t, names, 2)
+	assert.Equal(t, stateFile, names[0])
+	assert.True(t, strings.HasPrefix(names[1], stateFile+".corrupt-"), names)
+	restart(t, restarted, bucket)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, stateFile)
+	assert.NoError(t, writeFileAtomic(filename, []byte("hello, world")))
+	assert.NoError(t, writeFileAtomic(filename, []byte("bye")))
+	content, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "bye", string(content))
+
+	// No temporary files are left behind
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
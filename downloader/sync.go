@@ -0,0 +1,342 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/log"
+	"github.com/albertwidi/akouste/pkg/storage"
+)
+
+// Error variables
+var (
+	ErrEmptyPrefix  = errors.New("empty sync prefix")
+	ErrSyncConflict = errors.New("sync directory is a downloaded version")
+	ErrSyncedDir    = errors.New("destination is a synced directory")
+)
+
+// SyncRequest mirrors the objects under a bucket prefix into a directory of DestPath
+type SyncRequest struct {
+	// Directory of the bucket to mirror, a trailing '/' is added when missing
+	Prefix string `json:"prefix"`
+	// Name of the directory in DestPath, defaults to the last segment of Prefix
+	Dir string `json:"dir"`
+	// Delete the local files which no longer exist under Prefix
+	Delete bool `json:"delete"`
+}
+
+// SyncResult summarizes a sync, the files are relative to Dir
+type SyncResult struct {
+	Prefix string `json:"prefix"`
+	// Path of the directory the prefix is mirrored to
+	Dir       string   `json:"dir"`
+	Added     []string `json:"added"`
+	Updated   []string `json:"updated"`
+	Removed   []string `json:"removed"`
+	Unchanged int      `json:"unchanged"`
+	// Number of bytes downloaded
+	Bytes int64 `json:"bytes"`
+}
+
+// syncRecord is what the downloader records about a synced directory
+type syncRecord struct {
+	Prefix string `json:"prefix"`
+	// Objects the files were downloaded from, by path relative to the directory
+	Objects  map[string]storage.Object `json:"objects"`
+	SyncedAt time.Time                 `json:"synced_at"`
+}
+
+// normalize validates r and fills its defaults
+func (r SyncRequest) normalize() (SyncRequest, error) {
+	if r.Prefix == "" {
+		return r, ErrEmptyPrefix
+	}
+	if !strings.HasSuffix(r.Prefix, "/") {
+		r.Prefix += "/"
+	}
+	if r.Dir == "" {
+		r.Dir = path.Base(strings.TrimSuffix(r.Prefix, "/"))
+	}
+	return r, validateVersionName(r.Dir)
+}
+
+// Sync downloads the objects under req.Prefix which are new or changed since the last sync
+// into DestPath/req.Dir, keeping their path relative to the prefix.
+// Synced directories are not versions, they are neither activated nor deleted by the retention,
+// and downloads, batches and rollbacks to them are rejected.
+func (d *Downloader) Sync(ctx context.Context, req SyncRequest) (*SyncResult, error) {
+	req, err := req.normalize()
+	if err != nil {
+		return nil, &downloadError{
+			status: http.StatusBadRequest,
+			code:   CodeInvalidRequest,
+			err:    err,
+		}
+	}
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	unlock := d.syncing.lock(req.Dir)
+	defer unlock()
+
+	objects, err := d.storage.List(ctx, req.Prefix)
+	if err != nil {
+		return nil, &downloadError{
+			status: http.StatusBadRequest,
+			code:   CodeDownloadFailed,
+			err:    fmt.Errorf("error listing %s: %s", req.Prefix, err.Error()),
+		}
+	}
+
+	recorded, err := d.registerSync(req)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(d.config.DestPath, req.Dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, &downloadError{
+			status: http.StatusInternalServerError,
+			code:   CodeInternal,
+			err:    fmt.Errorf("write file error: %s", err.Error()),
+		}
+	}
+
+	// What was downloaded is recorded even when the sync fails, it is not downloaded again
+	defer func() {
+		d.mu.Lock()
+		d.syncs[req.Dir] = &syncRecord{Prefix: req.Prefix, Objects: recorded, SyncedAt: time.Now()}
+		d.persist()
+		d.mu.Unlock()
+	}()
+
+	result := &SyncResult{Prefix: req.Prefix, Dir: dir, Added: []string{}, Updated: []string{}, Removed: []string{}}
+	remote := map[string]bool{}
+	job := newJob(req.Prefix)
+	for _, object := range objects {
+		if isSidecarKey(object.Key) {
+			continue
+		}
+		file, ok := syncPath(req.Prefix, object.Key)
+		if !ok {
+			log.Warnf("sync %s: skipping %s", req.Prefix, object.Key)
+			continue
+		}
+		remote[file] = true
+
+		localFile := filepath.Join(dir, filepath.FromSlash(file))
+		_, statErr := os.Stat(localFile)
+		if last, ok := recorded[file]; ok && statErr == nil && sameObject(last, object) {
+			result.Unchanged++
+			continue
+		}
+
+		if err := d.syncObject(ctx, req.Dir, object, localFile, job); err != nil {
+			return result, err
+		}
+		recorded[file] = object
+		result.Bytes += object.Size
+		if statErr == nil {
+			result.Updated = append(result.Updated, file)
+		} else {
+			result.Added = append(result.Added, file)
+		}
+	}
+
+	for file := range recorded {
+		if !remote[file] {
+			delete(recorded, file)
+		}
+	}
+	if req.Delete {
+		unlockDir := d.destinations.lock(req.Dir)
+		result.Removed, err = removeStale(dir, remote)
+		unlockDir()
+		if err != nil {
+			return result, &downloadError{
+				status: http.StatusInternalServerError,
+				code:   CodeInternal,
+				err:    fmt.Errorf("error delete: %s", err.Error()),
+			}
+		}
+	}
+
+	log.Infof("sync %s: %d added, %d updated, %d removed", req.Prefix, len(result.Added), len(result.Updated), len(result.Removed))
+	return result, nil
+}
+
+// registerSync records req.Dir as a synced directory unless it is a version,
+// it returns the objects recorded by the last sync of req.Prefix into req.Dir
+func (d *Downloader) registerSync(req SyncRequest) (map[string]storage.Object, error) {
+	unlock := d.destinations.lock(req.Dir)
+	defer unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	record, synced := d.syncs[req.Dir]
+	if _, ok := d.versions[req.Dir]; ok && !synced {
+		return nil, syncConflict(ErrSyncConflict, req.Dir)
+	}
+	recorded := map[string]storage.Object{}
+	if synced && record.Prefix == req.Prefix {
+		for file, object := range record.Objects {
+			recorded[file] = object
+		}
+	}
+	// Recorded before the directory is created, so the retention never takes it for a version
+	// and the downloads to it are rejected
+	if !synced {
+		d.syncs[req.Dir] = &syncRecord{Prefix: req.Prefix, Objects: map[string]storage.Object{}}
+	}
+	return recorded, nil
+}
+
+// checkNotSynced returns an error if one of names is a synced directory
+func (d *Downloader) checkNotSynced(names ...string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, name := range names {
+		if _, ok := d.syncs[name]; ok {
+			return syncConflict(ErrSyncedDir, name)
+		}
+	}
+	return nil
+}
+
+func syncConflict(err error, name string) error {
+	return &downloadError{
+		status: http.StatusConflict,
+		code:   CodeSyncConflict,
+		err:    fmt.Errorf("%s: %s", err.Error(), name),
+	}
+}
+
+// syncObject downloads object to localFile in dir, dir and the partial file in DestPath
+// are locked like the destinations of any download
+func (d *Downloader) syncObject(ctx context.Context, dir string, object storage.Object, localFile string, job *Job) error {
+	unlock := d.destinations.lockAll(dir, filepath.Base(object.Key))
+	defer unlock()
+
+	req := downloadRequest{URI: object.Key}
+	if d.config.ChecksumSidecar {
+		var err error
+		req.Checksum, err = sidecarChecksum(ctx, d.storage, req.URI)
+		if err != nil {
+			return &downloadError{
+				status: http.StatusBadRequest,
+				code:   CodeDownloadFailed,
+				err:    err,
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
+		return &downloadError{
+			status: http.StatusInternalServerError,
+			code:   CodeInternal,
+			err:    fmt.Errorf("write file error: %s", err.Error()),
+		}
+	}
+	_, err := d.fetch(ctx, req, object, localFile, job)
+	return err
+}
+
+// syncPath returns the slash separated path of key relative to prefix,
+// false for the keys which cannot be mirrored, e.g. with '..' segments
+func syncPath(prefix, key string) (string, bool) {
+	file := strings.TrimPrefix(key, prefix)
+	for _, segment := range strings.Split(file, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", false
+		}
+	}
+	return file, true
+}
+
+// removeStale deletes the files of dir which are not in remote, and the directories left empty.
+// It returns the slash separated paths of the deleted files relative to dir.
+func removeStale(dir string, remote map[string]bool) ([]string, error) {
+	removed := []string{}
+	dirs := []string{}
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if name != dir {
+				dirs = append(dirs, name)
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		file := filepath.ToSlash(rel)
+		if remote[file] {
+			return nil
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		removed = append(removed, file)
+		return nil
+	})
+
+	// Walk visits parents first, directories which are not empty are kept
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return removed, err
+}
+
+// HandlerSync mirrors a bucket prefix into a directory of DestPath and answers a summary
+// of the added, updated and removed files
+// Accepted POST form fields, or JSON body fields when Content-Type is application/json:
+// - prefix : directory of the bucket to mirror
+// - dir    : name of the directory in DestPath (optional, defaults to the last segment of prefix)
+// - delete : whether to delete the local files which no longer exist in the bucket (true/false)
+//
+// e.g. curl -X POST -d "prefix=app/configs/&delete=true" localhost:9000/v1/sync
+func (d *Downloader) HandlerSync(w http.ResponseWriter, r *http.Request) {
+	var req SyncRequest
+	if isJSON(r) {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&req); err != nil {
+			writeRequestError(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("parse json failed: %s", err.Error()))
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			writeRequestError(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Errorf("parse form failed: %s", err.Error()))
+			return
+		}
+		req.Prefix = r.PostForm.Get("prefix")
+		req.Dir = r.PostForm.Get("dir")
+		req.Delete = strings.ToLower(r.PostForm.Get("delete")) == "true"
+	}
+
+	result, err := d.Sync(context.Background(), req)
+	if err != nil {
+		writeDownloadError(w, r, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%d added, %d updated, %d removed\n", len(result.Added), len(result.Updated), len(result.Removed))
+}
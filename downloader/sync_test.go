@@ -0,0 +1,149 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeObject writes content to the object key of the local bucket
+func writeObject(t *testing.T, bucket, key, content string) {
+	name := filepath.Join(bucket, filepath.FromSlash(key))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+	assert.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+}
+
+func TestSync(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 1})
+	defer cleanup()
+	writeObject(t, bucket, "app/configs/a.yaml", "a: 1")
+	writeObject(t, bucket, "app/configs/sub/b.yaml", "b: 1")
+	writeObject(t, bucket, "app/configs/a.yaml.sha256", "not a config")
+	writeObject(t, bucket, "app/other.yaml", "other")
+
+	ctx := context.Background()
+	result, err := d.Sync(ctx, SyncRequest{Prefix: "app/configs"})
+	assert.NoError(t, err)
+	dir := filepath.Join(d.config.DestPath, "configs")
+	assert.Equal(t, &SyncResult{
+		Prefix:  "app/configs/",
+		Dir:     dir,
+		Added:   []string{"a.yaml", "sub/b.yaml"},
+		Updated: []string{},
+		Removed: []string{},
+		Bytes:   8,
+	}, result)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "sub", "b.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b: 1", string(content))
+	assert.False(t, pathExists(filepath.Join(dir, "a.yaml.sha256")))
+
+	// Unchanged objects are not downloaded again
+	result, err = d.Sync(ctx, SyncRequest{Prefix: "app/configs/"})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Added)
+	assert.Empty(t, result.Updated)
+	assert.Equal(t, 2, result.Unchanged)
+
+	writeObject(t, bucket, "app/configs/a.yaml", "a: 22")
+	writeObject(t, bucket, "app/configs/c.yaml", "c: 1")
+	assert.NoError(t, os.Remove(filepath.Join(bucket, "app", "configs", "sub", "b.yaml")))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "local.yaml"), []byte("local"), 0644))
+
+	result, err = d.Sync(ctx, SyncRequest{Prefix: "app/configs/"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c.yaml"}, result.Added)
+	assert.Equal(t, []string{"a.yaml"}, result.Updated)
+	assert.Empty(t, result.Removed)
+	assert.True(t, pathExists(filepath.Join(dir, "sub", "b.yaml")))
+
+	result, err = d.Sync(ctx, SyncRequest{Prefix: "app/configs/", Delete: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"local.yaml", "sub/b.yaml"}, result.Removed)
+	assert.Equal(t, 2, result.Unchanged)
+	assert.False(t, pathExists(filepath.Join(dir, "sub")))
+	content, err = ioutil.ReadFile(filepath.Join(dir, "a.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a: 22", string(content))
+
+	// Synced directories are not versions, the retention keeps them
+	copyFixture(t, bucket, "config-1.tar.gz")
+	copyFixture(t, bucket, "config-2.tar.gz")
+	for _, uri := range []string{"config-1.tar.gz", "config-2.tar.gz"} {
+		rr := postForm(d.HandlerDownload, url.Values{"uri": {uri}, "unarchive": {"true"}})
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+	assert.True(t, pathExists(dir))
+	versions, err := d.Versions()
+	assert.NoError(t, err)
+	for _, version := range versions {
+		assert.NotEqual(t, "configs", version.Name)
+	}
+
+	// The synced objects are remembered across restarts
+	d = restart(t, d, bucket)
+	result, err = d.Sync(ctx, SyncRequest{Prefix: "app/configs/"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Unchanged)
+
+	// A version cannot be synced into
+	_, err = d.Sync(ctx, SyncRequest{Prefix: "app/configs/", Dir: "config-2"})
+	assert.Equal(t, CodeSyncConflict, err.(*downloadError).code)
+}
+
+func TestSyncConflict(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	copyFixture(t, bucket, "config-1.tar.gz")
+	writeObject(t, bucket, "app/configs/a.yaml", "a: 1")
+
+	_, err := d.Sync(context.Background(), SyncRequest{Prefix: "app/configs/", Dir: "config-1"})
+	assert.NoError(t, err)
+
+	// Nothing replaces or activates the synced directory
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrSyncedDir.Error())
+	rr = postJSON(d.HandlerBatch, `{"version":"config-1","items":[{"uri":"config-1.tar.gz"}]}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeSyncConflict, decodeError(t, rr).Code)
+	_, err = d.Rollback("config-1")
+	assert.Equal(t, CodeSyncConflict, err.(*downloadError).code)
+
+	content, err := ioutil.ReadFile(filepath.Join(d.config.DestPath, "config-1", "a.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a: 1", string(content))
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Empty(t, active)
+}
+
+func TestHandlerSync(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+	writeObject(t, bucket, "app/configs/a.yaml", "a: 1")
+
+	rr := postForm(d.HandlerSync, url.Values{"prefix": {"app/configs/"}, "dir": {"app"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "1 added, 0 updated, 0 removed\n", rr.Body.String())
+	assert.FileExists(t, filepath.Join(d.config.DestPath, "app", "a.yaml"))
+
+	rr = postJSON(d.HandlerSync, `{"prefix":"app/configs/","dir":"app","delete":true}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result SyncResult
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Equal(t, 1, result.Unchanged)
+
+	for _, body := range []string{`{}`, `{"prefix":"app/configs/","dir":"current"}`, `{"prefix":"app/configs/","dir":"../app"}`} {
+		rr = postJSON(d.HandlerSync, body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Equal(t, CodeInvalidRequest, decodeError(t, rr).Code, body)
+	}
+}
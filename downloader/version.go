@@ -0,0 +1,141 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Version is a download retained in DestPath
+type Version struct {
+	// Name of the file or directory in DestPath
+	Name string `json:"name"`
+	// Source of the version in the bucket, empty when unknown
+	URI string `json:"uri"`
+	// Bucket provider the version was downloaded from, empty when unknown
+	Provider string `json:"provider"`
+	// Bucket the version was downloaded from, empty when unknown
+	Bucket string `json:"bucket"`
+	// When the version was downloaded, approximated by the modification time when unknown
+	DownloadedAt time.Time `json:"downloaded_at"`
+	// Size in bytes of the file, or of the files in the directory
+	Size int64 `json:"size"`
+	// Checksum of the downloaded file prefixed by its algorithm, e.g. sha256:<hex>
+	Checksum string `json:"checksum"`
+	// Sources of the items of a batch version, in request order
+	Items []string `json:"items,omitempty"`
+	// Whether the current link points to this version
+	Active bool `json:"active"`
+	// Whether the version is pinned, pinned versions are never deleted by the retention
+	Pinned bool `json:"pinned"`
+	// Whether this version is deleted by the retention on the next download
+	NextForDeletion bool `json:"next_for_deletion"`
+}
+
+// protected returns true for the versions the retention never deletes
+func (v Version) protected() bool {
+	return v.Active || v.Pinned
+}
+
+// downloaded returns a copy of v marked as downloaded now
+func (v *Version) downloaded() *Version {
+	version := *v
+	version.DownloadedAt = time.Now()
+	return &version
+}
+
+// Versions returns the versions retained in DestPath, the newest first
+func (d *Downloader) Versions() ([]Version, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	versions, err := d.retainedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	next := d.nextForDeletion(versions, time.Now())
+	for i := range versions {
+		versions[i].NextForDeletion = next[versions[i].Name]
+	}
+	return versions, nil
+}
+
+// retainedVersions returns the versions in DestPath, the newest first, d.mu must be held.
+// Versions the downloader has no record of are dated by their modification time.
+func (d *Downloader) retainedVersions() ([]Version, error) {
+	entries, err := ioutil.ReadDir(d.config.DestPath)
+	if err != nil {
+		return nil, err
+	}
+	active, err := d.activeVersion()
+	if err != nil {
+		return nil, err
+	}
+	pinned := map[string]bool{}
+	for _, name := range d.config.Pinned {
+		pinned[name] = true
+	}
+
+	versions := []Version{}
+	for _, entry := range entries {
+		if !isVersionEntry(entry.Name()) {
+			continue
+		}
+		// Synced directories are updated in place, they are not versions
+		if _, ok := d.syncs[entry.Name()]; ok {
+			continue
+		}
+
+		version := Version{
+			Name:         entry.Name(),
+			DownloadedAt: entry.ModTime(),
+		}
+		if record, ok := d.versions[entry.Name()]; ok {
+			version = *record
+		}
+		version.Active = entry.Name() == active
+		version.Pinned = pinned[entry.Name()]
+		version.Size, err = diskUsage(filepath.Join(d.config.DestPath, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	sort.SliceStable(versions, func(left, right int) bool {
+		return versions[left].DownloadedAt.After(versions[right].DownloadedAt)
+	})
+	return versions, nil
+}
+
+// diskUsage returns the total size of the regular files in path
+func diskUsage(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// HandlerVersions lists the versions retained in DestPath as JSON
+//
+// e.g. curl localhost:9000/v1/versions
+func (d *Downloader) HandlerVersions(w http.ResponseWriter, r *http.Request) {
+	versions, err := d.Versions()
+	if err != nil {
+		writeDownloadError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, versions)
+}
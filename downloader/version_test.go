@@ -0,0 +1,55 @@
+package downloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerVersions(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 2})
+	defer cleanup()
+
+	// A version the downloader knows nothing about
+	err := os.Mkdir(filepath.Join(d.config.DestPath, "config-0"), 0755)
+	assert.NoError(t, err)
+	// Hidden working entries are not versions
+	err = os.Mkdir(filepath.Join(d.config.DestPath, ".staging-config-0"), 0755)
+	assert.NoError(t, err)
+
+	copyFixture(t, bucket, "config-1.tar.gz")
+	rr := postForm(d.HandlerDownload, url.Values{"uri": {"config-1.tar.gz"}, "unarchive": {"true"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	content, err := ioutil.ReadFile(filepath.Join(bucket, "config-1.tar.gz"))
+	assert.NoError(t, err)
+
+	rr = httptest.NewRecorder()
+	d.HandlerVersions(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	versions := []Version{}
+	err = json.NewDecoder(rr.Body).Decode(&versions)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	assert.Equal(t, "config-1", versions[0].Name)
+	assert.Equal(t, "config-1.tar.gz", versions[0].URI)
+	assert.Equal(t, "local-file", versions[0].Provider)
+	assert.Equal(t, "sha256:"+sha256Hex(string(content)), versions[0].Checksum)
+	assert.Equal(t, int64(26), versions[0].Size)
+	assert.True(t, versions[0].Active)
+	assert.False(t, versions[0].NextForDeletion)
+
+	assert.Equal(t, "config-0", versions[1].Name)
+	assert.Empty(t, versions[1].URI)
+	assert.False(t, versions[1].Active)
+	assert.True(t, versions[1].NextForDeletion)
+}
@@ -0,0 +1,156 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/log"
+	"github.com/albertwidi/akouste/pkg/signature"
+	"github.com/albertwidi/akouste/pkg/storage"
+)
+
+// Error variables
+var (
+	ErrInvalidWatchInterval = errors.New("watch interval must be positive")
+	ErrInvalidWatchOrder    = errors.New("watch order must be 'name' or 'modtime'")
+)
+
+// List of watch orderings, used to pick the newest object under the watched prefix
+const (
+	WatchOrderName    = "name"
+	WatchOrderModTime = "modtime"
+)
+
+// WatchConfig of the bucket polling mode
+type WatchConfig struct {
+	// Only objects whose key starts with Prefix are watched
+	Prefix string
+	// Time between two listings of the bucket
+	Interval time.Duration
+	// How the newest object is picked, WatchOrderName (default) or WatchOrderModTime
+	OrderBy string
+	// Whether to unarchive the downloaded objects
+	Unarchive bool
+}
+
+// Validate validates configuration
+func (c WatchConfig) Validate() error {
+	if c.Interval <= 0 {
+		return ErrInvalidWatchInterval
+	}
+	if c.OrderBy != "" && c.OrderBy != WatchOrderName && c.OrderBy != WatchOrderModTime {
+		return ErrInvalidWatchOrder
+	}
+	return nil
+}
+
+// watcher keeps track of the last object downloaded by Watch
+type watcher struct {
+	d      *Downloader
+	config WatchConfig
+	last   *storage.Object
+}
+
+// Watch polls the bucket every config.Interval and downloads the newest object under
+// config.Prefix whenever it changes, using the same pipeline as HandlerDownload.
+// It blocks until ctx is done, and the download in progress, if any, returned.
+func (d *Downloader) Watch(ctx context.Context, config WatchConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	w := &watcher{
+		d:      d,
+		config: config,
+	}
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.poll(ctx); err != nil {
+			log.Warnf("watch %s: %s", config.Prefix, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll downloads the newest object if it changed since the last successful download
+func (w *watcher) poll(ctx context.Context) error {
+	objects, err := w.d.storage.List(ctx, w.config.Prefix)
+	if err != nil {
+		return err
+	}
+
+	newest := newestObject(objects, w.config.OrderBy)
+	if newest == nil {
+		log.Debugf("watch %s: no object found", w.config.Prefix)
+		return nil
+	}
+	if w.last != nil && w.last.Key == newest.Key && w.last.ModTime.Equal(newest.ModTime) && bytes.Equal(w.last.MD5, newest.MD5) {
+		return nil
+	}
+
+	log.Infof("watch %s: downloading %s", w.config.Prefix, newest.Key)
+	req := downloadRequest{
+		URI:       newest.Key,
+		Unarchive: w.config.Unarchive,
+	}
+	if err := validateURI(req.URI); err != nil {
+		return err
+	}
+
+	// Like asynchronous downloads, a download started by the watch is not cancelled with it,
+	// it is drained or cancelled by Shutdown
+	job := newJob(req.URI)
+	w.d.jobs.add(job)
+	if _, err := w.d.download(context.Background(), req, job); err != nil {
+		// Keep the last object so the download is retried on the next poll
+		return err
+	}
+
+	w.last = newest
+	return nil
+}
+
+// newestObject returns the newest artifact of objects, ignoring checksum and signature objects
+func newestObject(objects []storage.Object, orderBy string) *storage.Object {
+	artifacts := []storage.Object{}
+	for _, obj := range objects {
+		if !isSidecarKey(obj.Key) {
+			artifacts = append(artifacts, obj)
+		}
+	}
+	if len(artifacts) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(artifacts, func(left, right int) bool {
+		if orderBy == WatchOrderModTime && !artifacts[left].ModTime.Equal(artifacts[right].ModTime) {
+			return artifacts[left].ModTime.Before(artifacts[right].ModTime)
+		}
+		return artifacts[left].Key < artifacts[right].Key
+	})
+	return &artifacts[len(artifacts)-1]
+}
+
+// isSidecarKey returns true for the checksum and signature objects stored next to artifacts
+func isSidecarKey(key string) bool {
+	if strings.HasSuffix(key, signature.Extension) {
+		return true
+	}
+	for _, algorithm := range checksumAlgorithms {
+		if strings.HasSuffix(key, "."+algorithm) {
+			return true
+		}
+	}
+	return false
+}
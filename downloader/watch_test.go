@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchPoll(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+
+	err := os.Mkdir(filepath.Join(bucket, "app"), 0755)
+	assert.NoError(t, err)
+	w := &watcher{
+		d:      d,
+		config: WatchConfig{Prefix: "app/", Interval: time.Second, Unarchive: true},
+	}
+
+	// Nothing to download yet
+	assert.NoError(t, w.poll(context.TODO()))
+	assert.Nil(t, w.last)
+
+	copyFixture(t, filepath.Join(bucket, "app"), "config-1.tar.gz")
+	// Sidecars are never picked as the newest object
+	err = ioutil.WriteFile(filepath.Join(bucket, "app", "config-1.tar.gz.sha256"), []byte(""), 0644)
+	assert.NoError(t, err)
+	assert.NoError(t, w.poll(context.TODO()))
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", active)
+
+	// Unchanged bucket, nothing is downloaded
+	assert.NoError(t, os.RemoveAll(filepath.Join(d.config.DestPath, "config-1")))
+	assert.NoError(t, w.poll(context.TODO()))
+	_, err = os.Stat(filepath.Join(d.config.DestPath, "config-1"))
+	assert.True(t, os.IsNotExist(err))
+
+	copyFixture(t, filepath.Join(bucket, "app"), "config-2.tar.gz")
+	assert.NoError(t, w.poll(context.TODO()))
+	active, err = d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-2", active)
+}
+
+func TestWatchStop(t *testing.T) {
+	d, bucket, cleanup := newTestDownloader(t, Config{KeepOldCount: 5})
+	defer cleanup()
+	err := os.Mkdir(filepath.Join(bucket, "app"), 0755)
+	assert.NoError(t, err)
+	copyFixture(t, filepath.Join(bucket, "app"), "config-1.tar.gz")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- d.Watch(ctx, WatchConfig{Prefix: "app/", Interval: 10 * time.Millisecond, Unarchive: true})
+	}()
+	for i := 0; i < 100; i++ {
+		if active, _ := d.activeVersion(); active == "config-1" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The watch is stopped before the downloader is shut down
+	cancel()
+	select {
+	case err := <-stopped:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop")
+	}
+	assert.NoError(t, d.Shutdown(context.Background()))
+	active, err := d.activeVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1", active)
+}
+
+func TestNewestObject(t *testing.T) {
+	now := time.Now()
+	objects := []storage.Object{
+		{Key: "config-1.tar.gz", ModTime: now},
+		{Key: "config-2.tar.gz", ModTime: now.Add(-time.Hour)},
+		{Key: "config-3.tar.gz.sig", ModTime: now.Add(time.Hour)},
+	}
+
+	assert.Equal(t, "config-2.tar.gz", newestObject(objects, WatchOrderName).Key)
+	assert.Equal(t, "config-1.tar.gz", newestObject(objects, WatchOrderModTime).Key)
+	assert.Nil(t, newestObject(objects[2:], WatchOrderName))
+}
+
+func TestWatchConfigValidate(t *testing.T) {
+	assert.NoError(t, WatchConfig{Interval: time.Second}.Validate())
+	assert.Equal(t, ErrInvalidWatchInterval, WatchConfig{}.Validate())
+	assert.Equal(t, ErrInvalidWatchOrder, WatchConfig{Interval: time.Second, OrderBy: "size"}.Validate())
+}
@@ -1,10 +1,48 @@
 package archive
 
-import "github.com/mholt/archiver"
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mholt/archiver"
+)
+
+// Error variables
+var (
+	ErrAbsolutePath       = errors.New("absolute path")
+	ErrPathTraversal      = errors.New("path traversal")
+	ErrLinkEscape         = errors.New("link points outside the destination")
+	ErrSpecialFile        = errors.New("special files are not allowed")
+	ErrUnsupportedArchive = errors.New("unsupported archive format")
+)
+
+// maxLinkHops limits the number of links followed while resolving a path,
+// the same way the kernel stops at too many levels of symbolic links
+const maxLinkHops = 40
+
+// EntryError is returned when an archive entry is rejected,
+// Err is one of the error variables of this package
+type EntryError struct {
+	Entry string
+	Err   error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Entry, e.Err.Error())
+}
 
 // Unarchive unarchives the given archive file into the destination folder.
 // The archive format is selected implicitly.
+// The archive is validated first and nothing is extracted when Validate fails.
 func Unarchive(source, destination string) error {
+	if err := Validate(source); err != nil {
+		return err
+	}
 	return archiver.Unarchive(source, destination)
 }
 
@@ -13,3 +51,172 @@ func Unarchive(source, destination string) error {
 func Archive(sources []string, destination string) error {
 	return archiver.Archive(sources, destination)
 }
+
+// entry is the part of an archive entry which matters for validation
+type entry struct {
+	name     string
+	link     string
+	hardLink bool
+}
+
+// Validate makes sure every entry of the archive stays inside the destination directory.
+// It rejects absolute paths, paths containing '..', links pointing outside the destination,
+// entries written through such links and special files like devices.
+// The returned error is an *EntryError for rejected entries,
+// ErrUnsupportedArchive when source is not a tar or zip archive, whose headers cannot be validated.
+func Validate(source string) error {
+	format, err := archiver.ByExtension(source)
+	if err != nil {
+		return ErrUnsupportedArchive
+	}
+	switch format.(type) {
+	case *archiver.Tar, *archiver.TarBz2, *archiver.TarGz, *archiver.TarLz4, *archiver.TarSz, *archiver.TarXz, *archiver.Zip:
+	default:
+		return ErrUnsupportedArchive
+	}
+
+	entries := []entry{}
+	var entryErr error
+	err = archiver.Walk(source, func(f archiver.File) error {
+		e, err := newEntry(f)
+		if err != nil {
+			// archiver only keeps the message of the returned error
+			entryErr = err
+			return archiver.ErrStopWalk
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if entryErr != nil {
+		return entryErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Links are only known once every entry is read, a link declared later
+	// may change where an earlier entry resolves to
+	links := map[string]string{}
+	for _, e := range entries {
+		if e.link != "" && !e.hardLink {
+			links[e.name] = e.link
+		}
+	}
+
+	for _, e := range entries {
+		dir := path.Dir(e.name)
+		if !inside(dir, links) {
+			return &EntryError{Entry: e.name, Err: ErrLinkEscape}
+		}
+		if e.link == "" {
+			continue
+		}
+
+		target := e.link
+		if !e.hardLink {
+			// Symbolic links are relative to their directory, hard links to the archive root.
+			// The target is not cleaned, '..' must be applied after following links.
+			target = dir + "/" + e.link
+		}
+		if !inside(target, links) {
+			return &EntryError{Entry: e.name, Err: ErrLinkEscape}
+		}
+	}
+
+	return nil
+}
+
+// newEntry validates the name and type of f
+func newEntry(f archiver.File) (entry, error) {
+	var e entry
+	switch h := f.Header.(type) {
+	case *tar.Header:
+		e.name = h.Name
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeXGlobalHeader:
+		case tar.TypeSymlink:
+			e.link = h.Linkname
+		case tar.TypeLink:
+			e.link = h.Linkname
+			e.hardLink = true
+		default:
+			return e, &EntryError{Entry: h.Name, Err: ErrSpecialFile}
+		}
+
+	case zip.FileHeader:
+		e.name = h.Name
+		// Symbolic links in zip archives are extracted as regular files
+		if h.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+			return e, &EntryError{Entry: h.Name, Err: ErrSpecialFile}
+		}
+
+	default:
+		return e, ErrUnsupportedArchive
+	}
+
+	if err := validateName(e.name); err != nil {
+		return e, &EntryError{Entry: e.name, Err: err}
+	}
+	if e.link != "" {
+		if err := validateName(e.link); err == ErrAbsolutePath || (e.hardLink && err != nil) {
+			return e, &EntryError{Entry: e.name, Err: ErrLinkEscape}
+		}
+	}
+
+	e.name = path.Clean(strings.TrimPrefix(e.name, "./"))
+	return e, nil
+}
+
+// validateName rejects absolute names and names with a '..' element
+func validateName(name string) error {
+	name = strings.Replace(name, `\`, "/", -1)
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return ErrAbsolutePath
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return ErrPathTraversal
+		}
+	}
+	return nil
+}
+
+// inside follows the links of the archive along name and returns false
+// when it leaves the archive root
+func inside(name string, links map[string]string) bool {
+	pending := strings.Split(name, "/")
+	current := []string{}
+	hops := 0
+
+	for len(pending) > 0 {
+		element := pending[0]
+		pending = pending[1:]
+
+		switch element {
+		case "", ".":
+			continue
+		case "..":
+			if len(current) == 0 {
+				return false
+			}
+			current = current[:len(current)-1]
+			continue
+		}
+
+		current = append(current, element)
+		target, isLink := links[strings.Join(current, "/")]
+		if !isLink {
+			continue
+		}
+
+		hops++
+		if hops > maxLinkHops || strings.HasPrefix(target, "/") {
+			return false
+		}
+		// Replace the link by its target, which is relative to the link directory
+		current = current[:len(current)-1]
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	return true
+}
@@ -1,6 +1,9 @@
 package archive
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -30,3 +33,156 @@ func TestUnarchive(t *testing.T) {
 
 	_ = os.RemoveAll(targetFile)
 }
+
+// tarEntry describes an entry of a generated test archive
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+}
+
+// writeTarGz creates a gzipped tarball containing entries in a temporary directory
+func writeTarGz(t *testing.T, entries []tarEntry) string {
+	dir, err := ioutil.TempDir("", "akouste-archive")
+	assert.NoError(t, err)
+	archivePath := filepath.Join(dir, "test.tar.gz")
+
+	f, err := os.Create(archivePath)
+	assert.NoError(t, err)
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		content := []byte{}
+		if e.typeflag == tar.TypeReg {
+			content = []byte("content")
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(content)),
+		})
+		assert.NoError(t, err)
+		_, err = tw.Write(content)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	assert.NoError(t, f.Close())
+
+	return archivePath
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []tarEntry
+		err     error
+	}{
+		{
+			name: "valid with internal links",
+			entries: []tarEntry{
+				{name: "sub/", typeflag: tar.TypeDir},
+				{name: "sub/a.yaml", typeflag: tar.TypeReg},
+				{name: "a.yaml", typeflag: tar.TypeSymlink, linkname: "sub/a.yaml"},
+				{name: "sub/b.yaml", typeflag: tar.TypeSymlink, linkname: "../a.yaml"},
+				{name: "c.yaml", typeflag: tar.TypeLink, linkname: "sub/a.yaml"},
+			},
+		},
+		{
+			name:    "parent directory",
+			entries: []tarEntry{{name: "../evil.txt", typeflag: tar.TypeReg}},
+			err:     ErrPathTraversal,
+		},
+		{
+			name:    "nested parent directory",
+			entries: []tarEntry{{name: "sub/../../evil.txt", typeflag: tar.TypeReg}},
+			err:     ErrPathTraversal,
+		},
+		{
+			name:    "absolute path",
+			entries: []tarEntry{{name: "/tmp/evil.txt", typeflag: tar.TypeReg}},
+			err:     ErrAbsolutePath,
+		},
+		{
+			name:    "symlink outside",
+			entries: []tarEntry{{name: "link", typeflag: tar.TypeSymlink, linkname: "../../etc/passwd"}},
+			err:     ErrLinkEscape,
+		},
+		{
+			name:    "absolute symlink",
+			entries: []tarEntry{{name: "link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}},
+			err:     ErrLinkEscape,
+		},
+		{
+			name: "chained symlinks outside",
+			entries: []tarEntry{
+				{name: "up", typeflag: tar.TypeSymlink, linkname: "self/.."},
+				{name: "self", typeflag: tar.TypeSymlink, linkname: "."},
+			},
+			err: ErrLinkEscape,
+		},
+		{
+			name:    "hard link outside",
+			entries: []tarEntry{{name: "link", typeflag: tar.TypeLink, linkname: "../evil.txt"}},
+			err:     ErrLinkEscape,
+		},
+		{
+			name:    "character device",
+			entries: []tarEntry{{name: "null", typeflag: tar.TypeChar}},
+			err:     ErrSpecialFile,
+		},
+		{
+			name:    "fifo",
+			entries: []tarEntry{{name: "fifo", typeflag: tar.TypeFifo}},
+			err:     ErrSpecialFile,
+		},
+	}
+
+	for _, c := range cases {
+		archivePath := writeTarGz(t, c.entries)
+		err := Validate(archivePath)
+		os.RemoveAll(filepath.Dir(archivePath))
+
+		if c.err == nil {
+			assert.NoError(t, err, c.name)
+			continue
+		}
+		entryErr, ok := err.(*EntryError)
+		if assert.True(t, ok, "%s: expected *EntryError, got %v", c.name, err) {
+			assert.Equal(t, c.err, entryErr.Err, c.name)
+		}
+	}
+}
+
+func TestUnarchiveRejected(t *testing.T) {
+	archivePath := writeTarGz(t, []tarEntry{
+		{name: "good.txt", typeflag: tar.TypeReg},
+		{name: "link", typeflag: tar.TypeSymlink, linkname: ".."},
+		{name: "link/evil.txt", typeflag: tar.TypeReg},
+	})
+	dir := filepath.Dir(archivePath)
+	defer os.RemoveAll(dir)
+
+	destination := filepath.Join(dir, "extracted")
+	err := Unarchive(archivePath, destination)
+	assert.Error(t, err)
+	_, err = os.Stat(destination)
+	assert.True(t, os.IsNotExist(err), "nothing should be extracted")
+	_, err = os.Stat(filepath.Join(dir, "evil.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestValidateUnsupportedArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"config.rar", "config.txt.gz", "config.txt"} {
+		source := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(source, []byte("not validated"), 0644))
+		assert.Equal(t, ErrUnsupportedArchive, Validate(source), name)
+		assert.Equal(t, ErrUnsupportedArchive, Unarchive(source, filepath.Join(dir, "extracted")), name)
+	}
+}
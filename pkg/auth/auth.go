@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/log"
+)
+
+// Error variables
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrExpiredSignature   = errors.New("request timestamp out of range")
+	ErrURINotAllowed      = errors.New("uri not allowed")
+	ErrInvalidToken       = errors.New("invalid token")
+)
+
+// SchemeHMAC is the Authorization scheme of HMAC signed requests:
+// Authorization: AKOUSTE-HMAC-SHA256 token=<id>, timestamp=<unix seconds>, signature=<hex>
+const SchemeHMAC = "AKOUSTE-HMAC-SHA256"
+
+// maxSkew is how far the timestamp of a signed request may be from now
+const maxSkew = 5 * time.Minute
+
+// maxBodySize limits how much of a request body is read to authorize it
+const maxBodySize = 1 << 20
+
+// Error codes of the JSON error responses
+const (
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+)
+
+// Token is a credential of the API, scoped to the uris matching Allow
+type Token struct {
+	// ID of the token, sent in signed requests and logged
+	ID string `json:"id" yaml:"id"`
+	// Secret sent as bearer token, or used to sign requests
+	Secret string `json:"secret" yaml:"secret"`
+	// Patterns of the uris the token may download, every uri when empty.
+	// Patterns with '*', '?' or '[' are globs (path.Match), others are prefixes.
+	Allow []string `json:"allow" yaml:"allow"`
+}
+
+// Allows returns true if the token may download uri
+func (t *Token) Allows(uri string) bool {
+	if len(t.Allow) == 0 {
+		return true
+	}
+	// A prefix must not be escaped, e.g. configs/app/../secrets.tar.gz
+	for _, segment := range strings.Split(uri, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	for _, pattern := range t.Allow {
+		if strings.ContainsAny(pattern, "*?[") {
+			if ok, _ := path.Match(pattern, uri); ok {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(uri, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPrefix returns true if the token may download every key under prefix.
+// Glob patterns cannot cover the keys nested under a prefix, only allow-prefixes do.
+func (t *Token) AllowsPrefix(prefix string) bool {
+	if len(t.Allow) == 0 {
+		return true
+	}
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+	// As the downloader syncs it
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	for _, pattern := range t.Allow {
+		if !strings.ContainsAny(pattern, "*?[") && strings.HasPrefix(prefix, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate validates the token
+func (t *Token) validate() error {
+	if t.ID == "" || t.Secret == "" {
+		return fmt.Errorf("%s: id and secret are required", ErrInvalidToken.Error())
+	}
+	for _, pattern := range t.Allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: %s: pattern %q: %s", ErrInvalidToken.Error(), t.ID, pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+// LoadTokensFile reads a JSON array of tokens
+func LoadTokensFile(filename string) ([]Token, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []Token{}
+	if err := json.Unmarshal(content, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return tokens, nil
+}
+
+// Authenticator authenticates the requests with bearer tokens or HMAC signatures,
+// and authorizes the uri they download
+type Authenticator struct {
+	tokens map[string]*Token
+	now    func() time.Time
+}
+
+// New returns an Authenticator accepting the given tokens
+func New(tokens []Token) (*Authenticator, error) {
+	a := &Authenticator{tokens: make(map[string]*Token), now: time.Now}
+	for i := range tokens {
+		token := tokens[i]
+		if err := token.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := a.tokens[token.ID]; ok {
+			return nil, fmt.Errorf("%s: duplicate id %s", ErrInvalidToken.Error(), token.ID)
+		}
+		a.tokens[token.ID] = &token
+	}
+	return a, nil
+}
+
+type contextKey struct{}
+
+// TokenFromContext returns the token the request was authenticated with
+func TokenFromContext(ctx context.Context) *Token {
+	token, _ := ctx.Value(contextKey{}).(*Token)
+	return token
+}
+
+// Middleware rejects the requests which are not authenticated with 401 Unauthorized,
+// and the requests downloading a uri their token does not allow with 403 Forbidden
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err)
+			return
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		token, err := a.authenticate(r, body)
+		if err != nil {
+			log.Debugf("unauthenticated request to %s: %s", r.URL.Path, err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="akouste"`)
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, err)
+			return
+		}
+
+		uris, prefix, err := requestURIs(r, body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err)
+			return
+		}
+		for _, uri := range uris {
+			if !token.Allows(uri) {
+				log.Warnf("token %s is not allowed to download %s", token.ID, uri)
+				writeError(w, r, http.StatusForbidden, CodeForbidden, fmt.Errorf("%s: %s", ErrURINotAllowed.Error(), uri))
+				return
+			}
+		}
+		if prefix != "" && !token.AllowsPrefix(prefix) {
+			log.Warnf("token %s is not allowed to sync %s", token.ID, prefix)
+			writeError(w, r, http.StatusForbidden, CodeForbidden, fmt.Errorf("%s: %s", ErrURINotAllowed.Error(), prefix))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, token)))
+	})
+}
+
+// authenticate returns the token of the request
+func (a *Authenticator) authenticate(r *http.Request, body []byte) (*Token, error) {
+	authorization := r.Header.Get("Authorization")
+	parts := strings.SplitN(authorization, " ", 2)
+	if len(parts) != 2 {
+		return nil, ErrMissingCredentials
+	}
+
+	switch {
+	case strings.EqualFold(parts[0], "Bearer"):
+		secret := []byte(strings.TrimSpace(parts[1]))
+		var found *Token
+		// Every token is compared so the time taken does not tell which one matched
+		for _, token := range a.tokens {
+			if subtle.ConstantTimeCompare(secret, []byte(token.Secret)) == 1 {
+				found = token
+			}
+		}
+		if found == nil {
+			return nil, ErrInvalidCredentials
+		}
+		return found, nil
+
+	case parts[0] == SchemeHMAC:
+		params := parseParams(parts[1])
+		token, ok := a.tokens[params["token"]]
+		if !ok {
+			return nil, ErrInvalidCredentials
+		}
+		timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+		if err != nil {
+			return nil, ErrInvalidCredentials
+		}
+		skew := a.now().Sub(time.Unix(timestamp, 0))
+		if skew > maxSkew || skew < -maxSkew {
+			return nil, ErrExpiredSignature
+		}
+		expected := Sign(token.Secret, r.Method, r.URL.RequestURI(), timestamp, body)
+		if !hmac.Equal([]byte(expected), []byte(params["signature"])) {
+			return nil, ErrInvalidCredentials
+		}
+		return token, nil
+	}
+	return nil, ErrMissingCredentials
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a request, computed over
+// '<method>\n<request uri>\n<timestamp>\n<hex encoded sha256 of the body>'
+func Sign(secret, method, requestURI string, timestamp int64, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", method, requestURI, timestamp, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the Authorization header of r, whose body is body, signed with token
+func SignRequest(r *http.Request, token Token, body []byte, now time.Time) {
+	timestamp := now.Unix()
+	signature := Sign(token.Secret, r.Method, r.URL.RequestURI(), timestamp, body)
+	r.Header.Set("Authorization", fmt.Sprintf("%s token=%s, timestamp=%d, signature=%s", SchemeHMAC, token.ID, timestamp, signature))
+}
+
+// parseParams parses 'key=value, key=value' parameters
+func parseParams(s string) map[string]string {
+	params := map[string]string{}
+	for _, param := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		}
+	}
+	return params
+}
+
+// requestURIs returns the uris a request downloads, from its JSON or form body,
+// the uris of the items of batch requests included, and the prefix of sync requests.
+// The body is parsed as the handlers parse it, bodies which cannot be parsed are errors
+// so a request is never handled with uris which were not authorized.
+func requestURIs(r *http.Request, body []byte) ([]string, string, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, "", nil
+	}
+
+	var candidates []string
+	var prefix string
+	if isJSON(r) {
+		var fields struct {
+			URI    string `json:"uri"`
+			Prefix string `json:"prefix"`
+			Items  []struct {
+				URI string `json:"uri"`
+			} `json:"items"`
+		}
+		// The handlers decode the first JSON value of the body, trailing data included
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&fields); err != nil {
+			return nil, "", fmt.Errorf("parse json failed: %s", err.Error())
+		}
+		candidates = append(candidates, fields.URI)
+		for _, item := range fields.Items {
+			candidates = append(candidates, item.URI)
+		}
+		prefix = fields.Prefix
+	} else {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, "", fmt.Errorf("parse form failed: %s", err.Error())
+		}
+		candidates = append(candidates, values.Get("uri"))
+		prefix = values.Get("prefix")
+	}
+
+	var uris []string
+	for _, uri := range candidates {
+		if uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris, prefix, nil
+}
+
+// isJSON returns true if the request body is JSON encoded
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// writeError writes err in the format of the downloader errors,
+// JSON when the request is JSON or accepts it, plain text otherwise
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, err error) {
+	if isJSON(r) || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]string{"code": code, "message": err.Error()},
+		})
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTokens = []Token{
+	{ID: "deploy", Secret: "deploy-secret"},
+	{ID: "app", Secret: "app-secret", Allow: []string{"configs/app/", "flags-*.tar.gz"}},
+}
+
+// testServer returns a handler behind the middleware echoing the body and the token ID
+func testServer(t *testing.T) (*Authenticator, http.Handler) {
+	a, err := New(testTokens)
+	assert.NoError(t, err)
+	return a, a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		w.Write([]byte(TokenFromContext(r.Context()).ID + " " + string(body)))
+	}))
+}
+
+func formRequest(body string) *http.Request {
+	r := httptest.NewRequest("POST", "/v1/download", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestTokenAllows(t *testing.T) {
+	token := testTokens[1]
+	assert.True(t, token.Allows("configs/app/config-1.tar.gz"))
+	assert.True(t, token.Allows("flags-2.tar.gz"))
+	assert.False(t, token.Allows("configs/other/config-1.tar.gz"))
+	assert.False(t, token.Allows("flags/flags-2.tar.gz"))
+	assert.False(t, token.Allows("configs/app"))
+	assert.False(t, token.Allows("configs/app/../secrets.tar.gz"))
+	assert.True(t, testTokens[0].Allows("anything"))
+}
+
+func TestTokenAllowsPrefix(t *testing.T) {
+	token := Token{Allow: []string{"configs/app/", "configs/*", "flags-*"}}
+	assert.True(t, token.AllowsPrefix("configs/app/"))
+	assert.True(t, token.AllowsPrefix("configs/app"))
+	assert.True(t, token.AllowsPrefix("configs/app/nested/"))
+	// Keys nested under the prefix would escape the globs
+	assert.False(t, token.AllowsPrefix("configs/x"))
+	assert.False(t, token.AllowsPrefix("flags-"))
+	assert.False(t, token.AllowsPrefix("configs/"))
+	assert.False(t, token.AllowsPrefix("configs/app/../secrets/"))
+	assert.True(t, testTokens[0].AllowsPrefix("anything/"))
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New([]Token{{ID: "deploy"}})
+	assert.Error(t, err)
+	_, err = New([]Token{{ID: "deploy", Secret: "a"}, {ID: "deploy", Secret: "b"}})
+	assert.Error(t, err)
+	_, err = New([]Token{{ID: "deploy", Secret: "a", Allow: []string{"[config"}}})
+	assert.Error(t, err)
+}
+
+func TestBearer(t *testing.T) {
+	_, handler := testServer(t)
+
+	rr := serve(handler, formRequest("uri=config-1.tar.gz"))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+
+	r := formRequest("uri=config-1.tar.gz")
+	r.Header.Set("Authorization", "Bearer wrong")
+	rr = serve(handler, r)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// The body is still readable by the handler
+	r = formRequest("uri=config-1.tar.gz")
+	r.Header.Set("Authorization", "Bearer deploy-secret")
+	rr = serve(handler, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "deploy uri=config-1.tar.gz", rr.Body.String())
+}
+
+func TestAllowedURIs(t *testing.T) {
+	_, handler := testServer(t)
+
+	r := formRequest("uri=configs/app/config-1.tar.gz")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusOK, serve(handler, r).Code)
+
+	r = formRequest("uri=configs/other/config-1.tar.gz")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusForbidden, serve(handler, r).Code)
+
+	r = httptest.NewRequest("POST", "/v1/download", strings.NewReader(`{"uri":"secrets.tar.gz"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	rr := serve(handler, r)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), `"code":"forbidden"`)
+
+	// Trailing data does not hide the uri the handlers decode
+	r = httptest.NewRequest("POST", "/v1/download", strings.NewReader(`{"uri":"secrets.tar.gz"} x`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusForbidden, serve(handler, r).Code)
+
+	// Bodies which cannot be parsed are not authorized
+	for _, body := range []string{`{"uri":`, `x {"uri":"configs/app/config-1.tar.gz"}`, `{"uri":["secrets.tar.gz"]}`} {
+		r = httptest.NewRequest("POST", "/v1/download", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer app-secret")
+		assert.Equal(t, http.StatusBadRequest, serve(handler, r).Code, body)
+	}
+	r = formRequest("uri=%zz")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusBadRequest, serve(handler, r).Code)
+
+	// Every item of a batch must be allowed
+	r = httptest.NewRequest("POST", "/v1/batch", strings.NewReader(`{"items":[{"uri":"configs/app/base.tar.gz"},{"uri":"secrets.tar.gz"}]}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusForbidden, serve(handler, r).Code)
+
+	r = httptest.NewRequest("POST", "/v1/batch", strings.NewReader(`{"items":[{"uri":"configs/app/base.tar.gz"},{"uri":"configs/app/flags.json"}]}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusOK, serve(handler, r).Code)
+
+	// The prefix of a sync must be allowed
+	r = formRequest("prefix=configs/")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusForbidden, serve(handler, r).Code)
+
+	r = formRequest("prefix=configs/app/")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusOK, serve(handler, r).Code)
+
+	// Globs do not cover the keys nested under a prefix
+	r = formRequest("prefix=flags-x")
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusForbidden, serve(handler, r).Code)
+
+	// Requests without uri only need to be authenticated
+	r = httptest.NewRequest("GET", "/v1/versions", nil)
+	r.Header.Set("Authorization", "Bearer app-secret")
+	assert.Equal(t, http.StatusOK, serve(handler, r).Code)
+}
+
+func TestHMAC(t *testing.T) {
+	a, handler := testServer(t)
+	now := time.Unix(1560000000, 0)
+	a.now = func() time.Time { return now }
+	body := "uri=configs/app/config-1.tar.gz"
+
+	r := formRequest(body)
+	SignRequest(r, testTokens[1], []byte(body), now.Add(-time.Minute))
+	rr := serve(handler, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "app "+body, rr.Body.String())
+
+	// Tampered body
+	r = formRequest("uri=configs/app/config-2.tar.gz")
+	SignRequest(r, testTokens[1], []byte(body), now)
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, r).Code)
+
+	// Wrong secret
+	r = formRequest(body)
+	SignRequest(r, Token{ID: "app", Secret: "wrong"}, []byte(body), now)
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, r).Code)
+
+	// Signed too long ago
+	r = formRequest(body)
+	SignRequest(r, testTokens[1], []byte(body), now.Add(-time.Hour))
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, r).Code)
+
+	// Signed for another path
+	r = formRequest(body)
+	SignRequest(r, testTokens[1], []byte(body), now)
+	r.URL.Path = "/v1/rollback"
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, r).Code)
+
+	// Still scoped
+	body = "uri=secrets.tar.gz"
+	r = formRequest(body)
+	SignRequest(r, testTokens[1], []byte(body), now)
+	assert.Equal(t, http.StatusForbidden, serve(handler, r).Code)
+}
+
+func TestLoadTokensFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-auth")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "tokens.json")
+	content := `[{"id":"app","secret":"app-secret","allow":["configs/app/"]}]`
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+	tokens, err := LoadTokensFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", tokens[0].ID)
+	assert.Equal(t, "app-secret", tokens[0].Secret)
+	assert.Equal(t, []string{"configs/app/"}, tokens[0].Allow)
+
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("{"), 0600))
+	_, err = LoadTokensFile(filename)
+	assert.Error(t, err)
+}
@@ -0,0 +1,302 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Error variables
+var (
+	ErrUnknownSignal = errors.New("unknown signal")
+	ErrInvalidPID    = errors.New("invalid pid")
+	ErrHTTPStatus    = errors.New("unexpected http status")
+)
+
+// maxOutputSize limits how much of the output of a hook is recorded
+const maxOutputSize = 64 * 1024
+
+// List of events hooks are run for
+const (
+	EventActivate = "activate"
+	EventRollback = "rollback"
+)
+
+// Env describes the activated version, it is given to commands as environment variables
+// and to URLs as a JSON body
+type Env struct {
+	Event    string `json:"event"`
+	Version  string `json:"version"`
+	Dir      string `json:"dir"`
+	URI      string `json:"uri"`
+	Checksum string `json:"checksum"`
+}
+
+// Environ returns env as environment variables
+func (env Env) Environ() []string {
+	return []string{
+		"AKOUSTE_EVENT=" + env.Event,
+		"AKOUSTE_VERSION=" + env.Version,
+		"AKOUSTE_VERSION_DIR=" + env.Dir,
+		"AKOUSTE_URI=" + env.URI,
+		"AKOUSTE_CHECKSUM=" + env.Checksum,
+	}
+}
+
+// Result of a hook run
+type Result struct {
+	Hook       string        `json:"hook"`
+	Output     string        `json:"output,omitempty"`
+	ExitStatus int           `json:"exit_status"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Failed returns true if the hook failed
+func (r Result) Failed() bool {
+	return r.Error != ""
+}
+
+// Hook is run after a version is activated
+type Hook interface {
+	// String describes the hook in logs and results
+	String() string
+	// Run runs the hook for env, failures are reported in the result
+	Run(ctx context.Context, env Env) Result
+}
+
+// Command runs an executable with the Env variables added to its environment
+type Command struct {
+	Path string
+	Args []string
+	// The command is killed once it runs longer than Timeout, unless 0
+	Timeout time.Duration
+}
+
+// NewShellCommand returns a Command running command with /bin/sh
+func NewShellCommand(command string, timeout time.Duration) *Command {
+	return &Command{Path: "/bin/sh", Args: []string{"-c", command}, Timeout: timeout}
+}
+
+func (c *Command) String() string {
+	return "exec " + strings.Join(append([]string{c.Path}, c.Args...), " ")
+}
+
+// Run implements Hook
+func (c *Command) Run(ctx context.Context, env Env) Result {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	output := &limitedBuffer{limit: maxOutputSize}
+	cmd := exec.Command(c.Path, c.Args...)
+	cmd.Env = append(os.Environ(), env.Environ()...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// The command runs in its own process group, so the processes it started are killed with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			case <-done:
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	result := Result{
+		Hook:     c.String(),
+		Output:   output.String(),
+		Duration: time.Since(start),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitStatus = cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Signal sends a signal to a process, given by its PID or by a file holding its PID
+type Signal struct {
+	Signal  syscall.Signal
+	PID     int
+	PIDFile string
+}
+
+// signals are the signals Signal hooks can send, by name
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+}
+
+// ParseSignal returns the signal named name, e.g. SIGUSR2 or USR2
+func ParseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("%s: %q", ErrUnknownSignal.Error(), name)
+	}
+	return sig, nil
+}
+
+// NewSignal parses a '<signal>:<pid or pidfile>' specification, e.g. USR2:/var/run/app.pid
+func NewSignal(spec string) (*Signal, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("%s: %q, expected <signal>:<pid or pidfile>", ErrInvalidPID.Error(), spec)
+	}
+	sig, err := ParseSignal(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if pid, err := strconv.Atoi(parts[1]); err == nil {
+		return &Signal{Signal: sig, PID: pid}, nil
+	}
+	return &Signal{Signal: sig, PIDFile: parts[1]}, nil
+}
+
+func (s *Signal) String() string {
+	target := s.PIDFile
+	if target == "" {
+		target = strconv.Itoa(s.PID)
+	}
+	return fmt.Sprintf("signal %s %s", strings.ToUpper(s.Signal.String()), target)
+}
+
+// Run implements Hook
+func (s *Signal) Run(ctx context.Context, env Env) Result {
+	start := time.Now()
+	result := Result{Hook: s.String()}
+
+	err := s.send()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+func (s *Signal) send() error {
+	pid := s.PID
+	if s.PIDFile != "" {
+		content, err := ioutil.ReadFile(s.PIDFile)
+		if err != nil {
+			return err
+		}
+		pid, err = strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return fmt.Errorf("%s: %s", ErrInvalidPID.Error(), s.PIDFile)
+		}
+	}
+	if pid <= 0 {
+		return fmt.Errorf("%s: %d", ErrInvalidPID.Error(), pid)
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Signal(s.Signal)
+}
+
+// HTTP posts the Env as JSON to a URL, the hook fails unless the response status is 2xx
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *HTTP) String() string {
+	return "post " + h.URL
+}
+
+// Run implements Hook
+func (h *HTTP) Run(ctx context.Context, env Env) Result {
+	start := time.Now()
+	result := Result{Hook: h.String()}
+
+	output, err := h.post(ctx, env)
+	result.Output = output
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+func (h *HTTP) post(ctx context.Context, env Env) (string, error) {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	output, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOutputSize))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return string(output), fmt.Errorf("%s: %s", ErrHTTPStatus.Error(), resp.Status)
+	}
+	return string(output), nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	// Pretend everything is written so the command is not interrupted
+	return len(p), nil
+}
@@ -0,0 +1,146 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testEnv = Env{
+	Event:    EventActivate,
+	Version:  "config-1",
+	Dir:      "/downloads/config-1",
+	URI:      "configs/config-1.tar.gz",
+	Checksum: "sha256:abcd",
+}
+
+func TestCommand(t *testing.T) {
+	result := NewShellCommand(`echo "$AKOUSTE_EVENT $AKOUSTE_VERSION $AKOUSTE_VERSION_DIR $AKOUSTE_URI $AKOUSTE_CHECKSUM"`, 0).Run(context.TODO(), testEnv)
+	assert.False(t, result.Failed(), result.Error)
+	assert.Equal(t, 0, result.ExitStatus)
+	assert.Equal(t, "activate config-1 /downloads/config-1 configs/config-1.tar.gz sha256:abcd\n", result.Output)
+	assert.True(t, strings.HasPrefix(result.Hook, "exec /bin/sh -c echo"))
+
+	result = NewShellCommand("echo failing >&2; exit 3", 0).Run(context.TODO(), testEnv)
+	assert.True(t, result.Failed())
+	assert.Equal(t, 3, result.ExitStatus)
+	assert.Equal(t, "failing\n", result.Output)
+
+	result = (&Command{Path: "/does/not/exist"}).Run(context.TODO(), testEnv)
+	assert.True(t, result.Failed())
+}
+
+func TestCommandTimeout(t *testing.T) {
+	start := time.Now()
+	result := NewShellCommand("sleep 5", 100*time.Millisecond).Run(context.TODO(), testEnv)
+	assert.True(t, result.Failed())
+	assert.Equal(t, context.DeadlineExceeded.Error(), result.Error)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{limit: 4}
+	n, err := b.Write([]byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	n, err = b.Write([]byte("def"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "abcd", b.String())
+}
+
+func TestParseSignal(t *testing.T) {
+	for _, name := range []string{"USR2", "SIGUSR2", "usr2", "sigusr2"} {
+		sig, err := ParseSignal(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, syscall.SIGUSR2, sig)
+	}
+	_, err := ParseSignal("SIGFOO")
+	assert.Error(t, err)
+}
+
+func TestNewSignal(t *testing.T) {
+	s, err := NewSignal("HUP:42")
+	assert.NoError(t, err)
+	assert.Equal(t, &Signal{Signal: syscall.SIGHUP, PID: 42}, s)
+
+	s, err = NewSignal("SIGUSR2:/var/run/app.pid")
+	assert.NoError(t, err)
+	assert.Equal(t, &Signal{Signal: syscall.SIGUSR2, PIDFile: "/var/run/app.pid"}, s)
+
+	for _, spec := range []string{"", "USR2", "USR2:", "FOO:42"} {
+		_, err := NewSignal(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	received := make(chan os.Signal, 2)
+	signal.Notify(received, syscall.SIGUSR1)
+	defer signal.Stop(received)
+
+	waitSignal := func() {
+		select {
+		case sig := <-received:
+			assert.Equal(t, syscall.SIGUSR1, sig)
+		case <-time.After(5 * time.Second):
+			t.Fatal("signal not received")
+		}
+	}
+
+	result := (&Signal{Signal: syscall.SIGUSR1, PID: os.Getpid()}).Run(context.TODO(), testEnv)
+	assert.False(t, result.Failed(), result.Error)
+	waitSignal()
+
+	dir, err := ioutil.TempDir("", "akouste-hook")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "app.pid")
+	assert.NoError(t, ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644))
+
+	result = (&Signal{Signal: syscall.SIGUSR1, PIDFile: pidFile}).Run(context.TODO(), testEnv)
+	assert.False(t, result.Failed(), result.Error)
+	waitSignal()
+
+	result = (&Signal{Signal: syscall.SIGUSR1, PIDFile: filepath.Join(dir, "missing.pid")}).Run(context.TODO(), testEnv)
+	assert.True(t, result.Failed())
+	assert.NoError(t, ioutil.WriteFile(pidFile, []byte("not a pid"), 0644))
+	result = (&Signal{Signal: syscall.SIGUSR1, PIDFile: pidFile}).Run(context.TODO(), testEnv)
+	assert.True(t, result.Failed())
+}
+
+func TestHTTP(t *testing.T) {
+	var received Env
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		if r.URL.Path == "/fail" {
+			http.Error(w, "reload failed", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("reloaded"))
+	}))
+	defer server.Close()
+
+	result := (&HTTP{URL: server.URL + "/reload"}).Run(context.TODO(), testEnv)
+	assert.False(t, result.Failed(), result.Error)
+	assert.Equal(t, "reloaded", result.Output)
+	assert.Equal(t, testEnv, received)
+
+	result = (&HTTP{URL: server.URL + "/fail"}).Run(context.TODO(), testEnv)
+	assert.True(t, result.Failed())
+	assert.Equal(t, "reload failed\n", result.Output)
+}
@@ -0,0 +1,243 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Extension of the detached signature object uploaded next to an artifact
+const Extension = ".sig"
+
+// Error variables
+var (
+	ErrInvalidPublicKey     = errors.New("invalid public key")
+	ErrInvalidSignature     = errors.New("invalid signature")
+	ErrMessageTooLarge      = errors.New("message too large to verify")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signature algorithm")
+	ErrUntrustedKey         = errors.New("signature key is not trusted")
+)
+
+// MaxMessageSize limits how much of a message is read for raw ed25519 and legacy minisign
+// signatures, which sign the whole message instead of its hash
+const MaxMessageSize = 64 << 20
+
+// minisign constants, see https://jedisct1.github.io/minisign/
+const (
+	minisignAlgorithm       = "Ed"
+	minisignHashedAlgorithm = "ED"
+	minisignKeyIDSize       = 8
+	untrustedCommentPrefix  = "untrusted comment:"
+	trustedCommentPrefix    = "trusted comment: "
+)
+
+// PublicKey is a trusted ed25519 public key
+type PublicKey struct {
+	// minisign key ID, nil for raw keys
+	ID  []byte
+	Key ed25519.PublicKey
+}
+
+// ParsePublicKey parses a base64 encoded raw ed25519 public key,
+// or a minisign public key with or without its untrusted comment line
+func ParsePublicKey(data []byte) (PublicKey, error) {
+	lines := contentLines(data)
+	if len(lines) == 0 {
+		return PublicKey{}, ErrInvalidPublicKey
+	}
+
+	b, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("%s: %s", ErrInvalidPublicKey.Error(), err.Error())
+	}
+
+	switch len(b) {
+	case ed25519.PublicKeySize:
+		return PublicKey{Key: ed25519.PublicKey(b)}, nil
+
+	case len(minisignAlgorithm) + minisignKeyIDSize + ed25519.PublicKeySize:
+		if string(b[:2]) != minisignAlgorithm {
+			return PublicKey{}, fmt.Errorf("%s: %q", ErrUnsupportedAlgorithm.Error(), b[:2])
+		}
+		return PublicKey{
+			ID:  b[2 : 2+minisignKeyIDSize],
+			Key: ed25519.PublicKey(b[2+minisignKeyIDSize:]),
+		}, nil
+
+	default:
+		return PublicKey{}, fmt.Errorf("%s: unexpected size %d", ErrInvalidPublicKey.Error(), len(b))
+	}
+}
+
+// LoadPublicKeyFile reads a public key from filename
+func LoadPublicKeyFile(filename string) (PublicKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return PublicKey{}, err
+	}
+
+	key, err := ParsePublicKey(data)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return key, nil
+}
+
+// Sign returns a detached signature of message,
+// the base64 encoded ed25519 signature followed by a newline
+func Sign(key ed25519.PrivateKey, message []byte) []byte {
+	sig := ed25519.Sign(key, message)
+	return []byte(base64.StdEncoding.EncodeToString(sig) + "\n")
+}
+
+// Verifier verifies detached signatures against a set of trusted keys
+type Verifier struct {
+	keys []PublicKey
+}
+
+// NewVerifier returns a verifier trusting keys
+func NewVerifier(keys []PublicKey) *Verifier {
+	return &Verifier{keys: keys}
+}
+
+// Verify checks that sig is a valid signature of message made by one of the trusted keys.
+// sig is either a base64 encoded ed25519 signature as returned by Sign,
+// or a minisign signature file, legacy 'Ed' or pre-hashed 'ED'.
+func (v *Verifier) Verify(message, sig []byte) error {
+	return v.verify(sig, func(prehashed bool) ([]byte, error) {
+		if prehashed {
+			hash := blake2b.Sum512(message)
+			return hash[:], nil
+		}
+		return message, nil
+	})
+}
+
+// VerifyReader is like Verify for the message read from r.
+// Pre-hashed minisign signatures are verified while streaming r,
+// other signatures need the whole message in memory and fail with ErrMessageTooLarge
+// above MaxMessageSize.
+func (v *Verifier) VerifyReader(r io.Reader, sig []byte) error {
+	return v.verify(sig, func(prehashed bool) ([]byte, error) {
+		if prehashed {
+			// blake2b.New512 only fails on keys larger than 64 bytes
+			h, _ := blake2b.New512(nil)
+			if _, err := io.Copy(h, r); err != nil {
+				return nil, err
+			}
+			return h.Sum(nil), nil
+		}
+		message, err := ioutil.ReadAll(io.LimitReader(r, MaxMessageSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(message) > MaxMessageSize {
+			return nil, fmt.Errorf("%s: larger than %d bytes", ErrMessageTooLarge.Error(), MaxMessageSize)
+		}
+		return message, nil
+	})
+}
+
+// verify parses sig and checks it against the signed content returned by signed,
+// the BLAKE2b-512 hash of the message when prehashed is true, the message otherwise
+func (v *Verifier) verify(sig []byte, signed func(prehashed bool) ([]byte, error)) error {
+	lines := contentLines(sig)
+	if len(lines) == 0 {
+		return ErrInvalidSignature
+	}
+	b, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil {
+		return fmt.Errorf("%s: %s", ErrInvalidSignature.Error(), err.Error())
+	}
+
+	switch len(b) {
+	case ed25519.SignatureSize:
+		message, err := signed(false)
+		if err != nil {
+			return err
+		}
+		for _, key := range v.keys {
+			if ed25519.Verify(key.Key, message, b) {
+				return nil
+			}
+		}
+		return ErrInvalidSignature
+	case len(minisignAlgorithm) + minisignKeyIDSize + ed25519.SignatureSize:
+		return v.verifyMinisign(b, lines[1:], signed)
+	default:
+		return fmt.Errorf("%s: unexpected size %d", ErrInvalidSignature.Error(), len(b))
+	}
+}
+
+// verifyMinisign verifies a minisign signature, trailer holds the trusted comment
+// and the global signature lines
+func (v *Verifier) verifyMinisign(b []byte, trailer []string, signed func(prehashed bool) ([]byte, error)) error {
+	algorithm := string(b[:2])
+	keyID := b[2 : 2+minisignKeyIDSize]
+	sig := b[2+minisignKeyIDSize:]
+
+	// Pre-hashed signatures sign the BLAKE2b-512 hash of the message
+	var prehashed bool
+	switch algorithm {
+	case minisignAlgorithm:
+	case minisignHashedAlgorithm:
+		prehashed = true
+	default:
+		return fmt.Errorf("%s: %q", ErrUnsupportedAlgorithm.Error(), algorithm)
+	}
+
+	if len(trailer) < 2 || !strings.HasPrefix(trailer[0], trustedCommentPrefix) {
+		return fmt.Errorf("%s: missing trusted comment", ErrInvalidSignature.Error())
+	}
+	trustedComment := strings.TrimPrefix(trailer[0], trustedCommentPrefix)
+	globalSig, err := base64.StdEncoding.DecodeString(trailer[1])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("%s: invalid global signature", ErrInvalidSignature.Error())
+	}
+
+	message, err := signed(prehashed)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range v.keys {
+		if key.ID != nil && !bytes.Equal(key.ID, keyID) {
+			continue
+		}
+		if !ed25519.Verify(key.Key, message, sig) {
+			continue
+		}
+		// The trusted comment is signed along with the signature
+		if !ed25519.Verify(key.Key, append(append([]byte{}, sig...), trustedComment...), globalSig) {
+			return fmt.Errorf("%s: invalid global signature", ErrInvalidSignature.Error())
+		}
+		return nil
+	}
+
+	for _, key := range v.keys {
+		if bytes.Equal(key.ID, keyID) {
+			return ErrInvalidSignature
+		}
+	}
+	return ErrUntrustedKey
+}
+
+// contentLines returns the non empty lines of data, without untrusted comments
+func contentLines(data []byte) []string {
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, untrustedCommentPrefix) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,163 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+func generateKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	return pub, priv
+}
+
+func TestSignVerify(t *testing.T) {
+	pub, priv := generateKey(t)
+	otherPub, _ := generateKey(t)
+	message := []byte("config-1.tar.gz content")
+
+	key, err := ParsePublicKey([]byte(base64.StdEncoding.EncodeToString(pub) + "\n"))
+	assert.NoError(t, err)
+	otherKey, err := ParsePublicKey([]byte(base64.StdEncoding.EncodeToString(otherPub)))
+	assert.NoError(t, err)
+
+	sig := Sign(priv, message)
+	assert.NoError(t, NewVerifier([]PublicKey{otherKey, key}).Verify(message, sig))
+	assert.Equal(t, ErrInvalidSignature, NewVerifier([]PublicKey{otherKey}).Verify(message, sig))
+	assert.Equal(t, ErrInvalidSignature, NewVerifier([]PublicKey{key}).Verify([]byte("tampered"), sig))
+	assert.Error(t, NewVerifier([]PublicKey{key}).Verify(message, []byte("not a signature")))
+	assert.Error(t, NewVerifier([]PublicKey{key}).Verify(message, nil))
+}
+
+func TestParsePublicKeyInvalid(t *testing.T) {
+	_, err := ParsePublicKey([]byte(""))
+	assert.Error(t, err)
+	_, err = ParsePublicKey([]byte("bm90IGEga2V5"))
+	assert.Error(t, err)
+}
+
+// minisignFiles returns a minisign formatted public key and signature of message
+func minisignFiles(pub ed25519.PublicKey, priv ed25519.PrivateKey, algorithm string, message []byte, trustedComment string) ([]byte, []byte) {
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	pubKey := append(append([]byte(minisignAlgorithm), keyID...), pub...)
+	pubFile := fmt.Sprintf("untrusted comment: minisign public key 0807060504030201\n%s\n",
+		base64.StdEncoding.EncodeToString(pubKey))
+
+	signed := message
+	if algorithm == minisignHashedAlgorithm {
+		hash := blake2b.Sum512(message)
+		signed = hash[:]
+	}
+	sig := ed25519.Sign(priv, signed)
+	globalSig := ed25519.Sign(priv, append(append([]byte{}, sig...), trustedComment...))
+	sigLine := append(append([]byte(algorithm), keyID...), sig...)
+	sigFile := fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(sigLine), trustedComment, base64.StdEncoding.EncodeToString(globalSig))
+
+	return []byte(pubFile), []byte(sigFile)
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	pub, priv := generateKey(t)
+	message := []byte("config-1.tar.gz content")
+
+	pubFile, sigFile := minisignFiles(pub, priv, minisignAlgorithm, message, "timestamp:1555555555\tfile:config-1.tar.gz")
+	key, err := ParsePublicKey(pubFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, key.ID)
+
+	verifier := NewVerifier([]PublicKey{key})
+	assert.NoError(t, verifier.Verify(message, sigFile))
+	assert.Equal(t, ErrInvalidSignature, verifier.Verify([]byte("tampered"), sigFile))
+
+	// Tampering with the trusted comment invalidates the global signature
+	lines := contentLines(sigFile)
+	forged := fmt.Sprintf("%s\ntrusted comment: forged\n%s\n", lines[0], lines[2])
+	assert.Error(t, verifier.Verify(message, []byte(forged)))
+
+	// Keys with another ID are not trusted
+	otherPub, otherPriv := generateKey(t)
+	otherPubFile, _ := minisignFiles(otherPub, otherPriv, minisignAlgorithm, message, "comment")
+	otherKey, err := ParsePublicKey(otherPubFile)
+	assert.NoError(t, err)
+	otherKey.ID = []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	assert.Equal(t, ErrUntrustedKey, NewVerifier([]PublicKey{otherKey}).Verify(message, sigFile))
+
+	// Pre-hashed signatures sign the hash of the message
+	_, hashedSigFile := minisignFiles(pub, priv, minisignHashedAlgorithm, message, "comment")
+	assert.NoError(t, verifier.Verify(message, hashedSigFile))
+	assert.Equal(t, ErrInvalidSignature, verifier.Verify([]byte("tampered"), hashedSigFile))
+
+	_, unknownSigFile := minisignFiles(pub, priv, "Ex", message, "comment")
+	err = verifier.Verify(message, unknownSigFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrUnsupportedAlgorithm.Error())
+}
+
+func TestVerifyMinisignFixture(t *testing.T) {
+	key, err := LoadPublicKeyFile(filepath.Join("testdata", "minisign.pub"))
+	assert.NoError(t, err)
+	message, err := ioutil.ReadFile(filepath.Join("testdata", "config.yaml"))
+	assert.NoError(t, err)
+	sig, err := ioutil.ReadFile(filepath.Join("testdata", "config.yaml.minisig"))
+	assert.NoError(t, err)
+
+	verifier := NewVerifier([]PublicKey{key})
+	assert.NoError(t, verifier.Verify(message, sig))
+	assert.Equal(t, ErrInvalidSignature, verifier.Verify(append(message, '\n'), sig))
+}
+
+// zeros reads zero bytes forever
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestVerifyReader(t *testing.T) {
+	pub, priv := generateKey(t)
+	message := []byte("config-1.tar.gz content")
+	pubFile, sigFile := minisignFiles(pub, priv, minisignAlgorithm, message, "comment")
+	_, hashedSigFile := minisignFiles(pub, priv, minisignHashedAlgorithm, message, "comment")
+	key, err := ParsePublicKey(pubFile)
+	assert.NoError(t, err)
+	verifier := NewVerifier([]PublicKey{key})
+
+	assert.NoError(t, verifier.VerifyReader(bytes.NewReader(message), sigFile))
+	assert.NoError(t, verifier.VerifyReader(bytes.NewReader(message), hashedSigFile))
+	assert.Equal(t, ErrInvalidSignature, verifier.VerifyReader(bytes.NewReader([]byte("tampered")), hashedSigFile))
+	assert.NoError(t, NewVerifier([]PublicKey{{Key: pub}}).VerifyReader(bytes.NewReader(message), Sign(priv, message)))
+
+	// Signatures of the whole message are not read past MaxMessageSize
+	tooLarge := io.LimitReader(zeros{}, MaxMessageSize+1)
+	err = verifier.VerifyReader(tooLarge, sigFile)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrMessageTooLarge.Error())
+	tooLarge = io.LimitReader(zeros{}, MaxMessageSize+1)
+	err = NewVerifier([]PublicKey{{Key: pub}}).VerifyReader(tooLarge, Sign(priv, message))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrMessageTooLarge.Error())
+
+	f, err := os.Open(filepath.Join("testdata", "config.yaml"))
+	assert.NoError(t, err)
+	defer f.Close()
+	fixtureKey, err := LoadPublicKeyFile(filepath.Join("testdata", "minisign.pub"))
+	assert.NoError(t, err)
+	fixtureSig, err := ioutil.ReadFile(filepath.Join("testdata", "config.yaml.minisig"))
+	assert.NoError(t, err)
+	assert.NoError(t, NewVerifier([]PublicKey{fixtureKey}).VerifyReader(f, fixtureSig))
+}
@@ -2,6 +2,7 @@ package s3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,6 +12,16 @@ import (
 	"gocloud.dev/blob/s3blob"
 )
 
+// Error variables
+var (
+	ErrEmptyBucketName = errors.New("empty bucket name")
+	ErrIncompleteKeys  = errors.New("both client_id and client_secret are required")
+)
+
+// defaultRegion is used when no region is configured, S3 compatible services such as
+// MinIO accept it whatever their location
+const defaultRegion = "us-east-1"
+
 // S3 struct
 type S3 struct {
 	storageBlobBucket *blob.Bucket
@@ -28,13 +39,50 @@ type Config struct {
 	ForcePathStyle bool   `yaml:"force_path_style" json:"force_path_style"`
 	BucketProto    string `yaml:"bucket_proto" json:"bucket_proto"`
 	BucketURL      string `yaml:"bucket_url" json:"bucket_url"`
+
+	// Shared credentials file and profile, used when there are neither static keys nor
+	// AWS environment variables. Default to ~/.aws/credentials and the 'default' profile,
+	// or to the AWS_SHARED_CREDENTIALS_FILE and AWS_PROFILE environment variables
+	CredentialsFile string `yaml:"credentials_file" json:"credentials_file"`
+	Profile         string `yaml:"profile" json:"profile"`
+}
+
+// Validate validates configuration
+func (c Config) Validate() error {
+	if c.Bucket == "" {
+		return ErrEmptyBucketName
+	}
+	if (c.ClientID == "") != (c.ClientSecret == "") {
+		return ErrIncompleteKeys
+	}
+	return nil
+}
+
+// credentials returns the static keys of config when set, otherwise the first credentials found
+// in the AWS environment variables (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY) and the shared
+// credentials file
+func (c Config) credentials() *credentials.Credentials {
+	if c.ClientID != "" {
+		return credentials.NewStaticCredentials(c.ClientID, c.ClientSecret, "")
+	}
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{Filename: c.CredentialsFile, Profile: c.Profile},
+	})
 }
 
 // New S3 storage
 func New(ctx context.Context, config Config) (*S3, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Region == "" {
+		config.Region = defaultRegion
+	}
+
 	c := aws.Config{
 		Region:           aws.String(config.Region),
-		Credentials:      credentials.NewStaticCredentials(config.ClientID, config.ClientSecret, ""),
+		Credentials:      config.credentials(),
 		DisableSSL:       aws.Bool(config.DisableSSL),
 		S3ForcePathStyle: aws.Bool(config.ForcePathStyle),
 	}
@@ -0,0 +1,274 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is an in-process S3 compatible server, it serves the objects of a single bucket
+// to path-style requests
+type fakeS3 struct {
+	bucket  string
+	objects map[string][]byte
+	modTime time.Time
+
+	mu sync.Mutex
+	// Access key IDs the requests were signed with
+	accessKeys []string
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string        `xml:"Name"`
+	Prefix      string        `xml:"Prefix"`
+	KeyCount    int           `xml:"KeyCount"`
+	MaxKeys     int           `xml:"MaxKeys"`
+	IsTruncated bool          `xml:"IsTruncated"`
+	Contents    []listContent `xml:"Contents"`
+}
+
+type listContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Authorization: AWS4-HMAC-SHA256 Credential=<access key id>/<date>/<region>/s3/aws4_request, ...
+	auth := r.Header.Get("Authorization")
+	if i := strings.Index(auth, "Credential="); i >= 0 {
+		f.mu.Lock()
+		f.accessKeys = append(f.accessKeys, strings.SplitN(auth[i+len("Credential="):], "/", 2)[0])
+		f.mu.Unlock()
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		f.list(w, r)
+		return
+	}
+
+	content, ok := f.objects[parts[1]]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", etag(content))
+	w.Header().Set("Last-Modified", f.modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	var start int
+	status := http.StatusOK
+	if byteRange := r.Header.Get("Range"); byteRange != "" {
+		fmt.Sscanf(byteRange, "bytes=%d-", &start)
+		if start >= len(content) {
+			writeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(content)-start))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(content[start:])
+	}
+}
+
+// list answers ListObjects requests, version 1 and 2 responses only differ by optional fields
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listBucketResult{Name: f.bucket, Prefix: prefix, KeyCount: len(keys), MaxKeys: 1000}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, listContent{
+			Key:          key,
+			LastModified: f.modTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         etag(f.objects[key]),
+			Size:         len(f.objects[key]),
+			StorageClass: "STANDARD",
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(result)
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+	}
+}
+
+func etag(content []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(content)))
+}
+
+// setenv sets the environment variables of env and returns the function restoring them
+func setenv(env map[string]string) func() {
+	previous := map[string]*string{}
+	for key, value := range env {
+		if old, ok := os.LookupEnv(key); ok {
+			previous[key] = &old
+		} else {
+			previous[key] = nil
+		}
+		if value == "" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, value)
+		}
+	}
+	return func() {
+		for key, old := range previous {
+			if old == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *old)
+			}
+		}
+	}
+}
+
+func TestS3(t *testing.T) {
+	modTime := time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	fake := &fakeS3{
+		bucket: "configs",
+		objects: map[string][]byte{
+			"app/config-1.tar.gz": []byte("config one"),
+			"app/config-2.tar.gz": []byte("config two"),
+			"other/config.yaml":   []byte("other"),
+		},
+		modTime: modTime,
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	ctx := context.Background()
+	provider, err := New(ctx, Config{
+		Endpoint:       server.URL,
+		Bucket:         "configs",
+		ClientID:       "AKIDSTATIC",
+		ClientSecret:   "secret",
+		DisableSSL:     true,
+		ForcePathStyle: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "s3", provider.Name())
+	s := storage.New(provider)
+
+	object, err := s.Attributes(ctx, "app/config-2.tar.gz")
+	assert.NoError(t, err)
+	sum := md5.Sum([]byte("config two"))
+	assert.Equal(t, int64(10), object.Size)
+	assert.Equal(t, sum[:], object.MD5)
+	assert.True(t, object.ModTime.Equal(modTime), object.ModTime.String())
+
+	reader, err := s.DownloadRange(ctx, "app/config-2.tar.gz", 7)
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, "two", string(content))
+
+	objects, err := s.List(ctx, "app/")
+	assert.NoError(t, err)
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	assert.Equal(t, []string{"app/config-1.tar.gz", "app/config-2.tar.gz"}, keys)
+
+	_, err = s.Attributes(ctx, "app/config-3.tar.gz")
+	assert.True(t, storage.IsNotExist(err))
+	_, err = s.Download(ctx, "app/config-3.tar.gz")
+	assert.True(t, storage.IsNotExist(err))
+
+	for _, accessKey := range fake.accessKeys {
+		assert.Equal(t, "AKIDSTATIC", accessKey)
+	}
+	assert.NotEmpty(t, fake.accessKeys)
+}
+
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-s3")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	credentialsFile := filepath.Join(dir, "credentials")
+	err = ioutil.WriteFile(credentialsFile, []byte(`[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = default-secret
+
+[spaces]
+aws_access_key_id = AKIDSPACES
+aws_secret_access_key = spaces-secret
+`), 0600)
+	assert.NoError(t, err)
+	restore := setenv(map[string]string{
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_ACCESS_KEY":              "",
+		"AWS_SECRET_KEY":              "",
+		"AWS_PROFILE":                 "",
+		"AWS_SHARED_CREDENTIALS_FILE": credentialsFile,
+	})
+	defer restore()
+
+	accessKey := func(config Config) string {
+		value, err := config.credentials().Get()
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		return value.AccessKeyID
+	}
+
+	assert.Equal(t, "AKIDDEFAULT", accessKey(Config{}))
+	assert.Equal(t, "AKIDSPACES", accessKey(Config{Profile: "spaces"}))
+	assert.Equal(t, "AKIDSPACES", accessKey(Config{CredentialsFile: credentialsFile, Profile: "spaces"}))
+
+	restoreEnv := setenv(map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "env-secret"})
+	assert.Equal(t, "AKIDENV", accessKey(Config{Profile: "spaces"}))
+	assert.Equal(t, "AKIDSTATIC", accessKey(Config{ClientID: "AKIDSTATIC", ClientSecret: "secret"}))
+	restoreEnv()
+
+	_, err = Config{CredentialsFile: filepath.Join(dir, "missing")}.credentials().Get()
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Config{Bucket: "configs"}.Validate())
+	assert.NoError(t, Config{Bucket: "configs", ClientID: "id", ClientSecret: "secret"}.Validate())
+	assert.Equal(t, ErrEmptyBucketName, Config{}.Validate())
+	assert.Equal(t, ErrIncompleteKeys, Config{Bucket: "configs", ClientID: "id"}.Validate())
+	assert.Equal(t, ErrIncompleteKeys, Config{Bucket: "configs", ClientSecret: "secret"}.Validate())
+}
@@ -2,11 +2,15 @@ package storage
 
 import (
 	"context"
+	"crypto/ed25519"
 	"io"
 	"io/ioutil"
 	"path"
+	"time"
 
+	"github.com/albertwidi/akouste/pkg/signature"
 	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
 )
 
 // Provider interface
@@ -49,6 +53,80 @@ func (s *Storage) download(ctx context.Context, key string) (io.ReadCloser, erro
 	return r, err
 }
 
+// DownloadRange returns a reader of the object at key starting from offset
+func (s *Storage) DownloadRange(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	blobBucket := s.provider.GetBlobBucket()
+	return blobBucket.NewRangeReader(ctx, key, offset, -1, &blob.ReaderOptions{})
+}
+
+// Object is an object listed from the bucket
+type Object struct {
+	Key     string    `json:"key"`
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+	MD5     []byte    `json:"md5,omitempty"`
+}
+
+// List returns the objects in the bucket whose key starts with prefix, ordered by key
+func (s *Storage) List(ctx context.Context, prefix string) ([]Object, error) {
+	blobBucket := s.provider.GetBlobBucket()
+	iter := blobBucket.List(&blob.ListOptions{Prefix: prefix})
+
+	objects := []Object{}
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if obj.IsDir {
+			continue
+		}
+
+		objects = append(objects, Object{
+			Key:     obj.Key,
+			ModTime: obj.ModTime,
+			Size:    obj.Size,
+			MD5:     obj.MD5,
+		})
+	}
+
+	return objects, nil
+}
+
+// Ping checks the bucket can be reached and listed, it reads at most one object
+func (s *Storage) Ping(ctx context.Context) error {
+	iter := s.provider.GetBlobBucket().List(&blob.ListOptions{})
+	_, err := iter.Next(ctx)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Attributes returns the attributes of the object at key without downloading it
+func (s *Storage) Attributes(ctx context.Context, key string) (Object, error) {
+	blobBucket := s.provider.GetBlobBucket()
+	attrs, err := blobBucket.Attributes(ctx, key)
+	if err != nil {
+		return Object{}, err
+	}
+
+	return Object{
+		Key:     key,
+		ModTime: attrs.ModTime,
+		Size:    attrs.Size,
+		MD5:     attrs.MD5,
+	}, nil
+}
+
+// IsNotExist returns true if err is caused by a missing object in the bucket
+func IsNotExist(err error) bool {
+	return err != nil && gcerrors.Code(err) == gcerrors.NotFound
+}
+
 // Upload file from bytes
 func (s *Storage) Upload(ctx context.Context, content []byte, destination string) (string, error) {
 	return s.upload(ctx, content, destination)
@@ -71,3 +149,21 @@ func (s *Storage) upload(ctx context.Context, content []byte, destination string
 
 	return uploadPath, err
 }
+
+// UploadFileSigned uploads the file from source to destination along with its detached
+// signature, made with key, to destination + signature.Extension.
+// The artifact is uploaded first so the signature never refers to a missing object.
+func (s *Storage) UploadFileSigned(ctx context.Context, source, destination string, key ed25519.PrivateKey) (string, error) {
+	p, err := ioutil.ReadFile(source)
+	if err != nil {
+		return "", err
+	}
+
+	uploadPath, err := s.upload(ctx, p, destination)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.upload(ctx, signature.Sign(key, p), destination+signature.Extension)
+	return uploadPath, err
+}
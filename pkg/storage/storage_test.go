@@ -3,9 +3,12 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"io/ioutil"
 	"os"
 	"testing"
 
+	"github.com/albertwidi/akouste/pkg/signature"
 	"github.com/albertwidi/akouste/pkg/storage/local"
 	"github.com/stretchr/testify/assert"
 )
@@ -51,3 +54,112 @@ func TestDownload(t *testing.T) {
 
 	assert.Equal(t, testByte, downloadedBuf.Bytes())
 }
+
+func TestDownloadRange(t *testing.T) {
+	testfile := "testfile-range.txt"
+	err := ioutil.WriteFile(testfile, []byte("hello, world"), 0644)
+	assert.NoError(t, err)
+	defer os.Remove(testfile)
+
+	readcloser, err := storage.DownloadRange(context.TODO(), testfile, 7)
+	assert.NoError(t, err)
+	defer readcloser.Close()
+	content, err := ioutil.ReadAll(readcloser)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(content))
+}
+
+func TestIsNotExist(t *testing.T) {
+	_, err := storage.Download(context.TODO(), "does-not-exist.txt")
+	assert.Error(t, err)
+	assert.True(t, IsNotExist(err))
+	assert.False(t, IsNotExist(nil))
+}
+
+func TestUploadFileSigned(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	source := "testfile-source.txt"
+	target := "testfile-signed.txt"
+	content := []byte("signed content")
+	err = ioutil.WriteFile(source, content, 0644)
+	assert.NoError(t, err)
+	defer func() {
+		for _, f := range []string{source, target, target + ".attrs", target + signature.Extension, target + signature.Extension + ".attrs"} {
+			os.RemoveAll(f)
+		}
+	}()
+
+	_, err = storage.UploadFileSigned(context.TODO(), source, target, priv)
+	assert.NoError(t, err)
+
+	sig, err := ioutil.ReadFile(target + signature.Extension)
+	assert.NoError(t, err)
+	verifier := signature.NewVerifier([]signature.PublicKey{{Key: pub}})
+	assert.NoError(t, verifier.Verify(content, sig))
+}
+
+func TestList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-list")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	localProvider, err := local.New(local.Config{Bucket: dir})
+	assert.NoError(t, err)
+	s := New(localProvider)
+
+	for _, key := range []string{"app/config-2.tar.gz", "app/config-1.tar.gz", "other/config-1.tar.gz"} {
+		_, err = s.Upload(context.TODO(), []byte(key), key)
+		assert.NoError(t, err)
+	}
+
+	objects, err := s.List(context.TODO(), "app/")
+	assert.NoError(t, err)
+	keys := []string{}
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+		assert.Equal(t, int64(len(obj.Key)), obj.Size)
+	}
+	assert.Equal(t, []string{"app/config-1.tar.gz", "app/config-2.tar.gz"}, keys)
+}
+
+func TestPing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-ping")
+	assert.NoError(t, err)
+
+	localProvider, err := local.New(local.Config{Bucket: dir})
+	assert.NoError(t, err)
+	s := New(localProvider)
+
+	// Empty buckets can be reached
+	assert.NoError(t, s.Ping(context.TODO()))
+	_, err = s.Upload(context.TODO(), []byte("config"), "app/config-1.tar.gz")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Ping(context.TODO()))
+
+	assert.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, s.Ping(context.TODO()))
+}
+
+func TestAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-attributes")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	localProvider, err := local.New(local.Config{Bucket: dir})
+	assert.NoError(t, err)
+	s := New(localProvider)
+
+	_, err = s.Upload(context.TODO(), []byte("hello"), "config-1.tar.gz")
+	assert.NoError(t, err)
+
+	obj, err := s.Attributes(context.TODO(), "config-1.tar.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "config-1.tar.gz", obj.Key)
+	assert.Equal(t, int64(5), obj.Size)
+	assert.False(t, obj.ModTime.IsZero())
+
+	_, err = s.Attributes(context.TODO(), "does-not-exist.tar.gz")
+	assert.True(t, IsNotExist(err))
+}
@@ -0,0 +1,200 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/log"
+)
+
+// Error variables
+var (
+	ErrMissingKeyPair     = errors.New("both a certificate and a key are required")
+	ErrInvalidClientCA    = errors.New("no certificate found in client CA file")
+	ErrClientCertRequired = errors.New("client certificate required")
+)
+
+// defaultReloadInterval is the time between two checks of the files
+const defaultReloadInterval = time.Minute
+
+// Config of the TLS files
+type Config struct {
+	// PEM encoded certificate chain and private key served to the clients
+	CertFile string
+	KeyFile  string
+
+	// PEM encoded CA certificates the client certificates must be signed by,
+	// client certificates are not requested when empty
+	ClientCAFile string
+
+	// Time between two checks of the files, defaults to 1 minute
+	ReloadInterval time.Duration
+}
+
+// Validate validates configuration
+func (c Config) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return ErrMissingKeyPair
+	}
+	return nil
+}
+
+// Reloader serves the certificate and client CAs of the files, reloaded when the files change
+type Reloader struct {
+	config Config
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// Content of the files currently loaded
+	loaded [][]byte
+}
+
+// New loads the files of config
+func New(config Config) (*Reloader, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.ReloadInterval <= 0 {
+		config.ReloadInterval = defaultReloadInterval
+	}
+
+	r := &Reloader{config: config}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the server configuration using the current certificate and client CAs.
+// Client certificates are verified when given, RequireClientCert rejects the requests without one.
+func (r *Reloader) TLSConfig() *tls.Config {
+	config := r.serverConfig()
+	if r.config.ClientCAFile != "" {
+		// The client CAs are part of the config, a copy with the current ones is returned to every client
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			client := config.Clone()
+			client.GetConfigForClient = nil
+			r.mu.RLock()
+			client.ClientCAs = r.clientCAs
+			r.mu.RUnlock()
+			return client, nil
+		}
+	}
+	return config
+}
+
+func (r *Reloader) serverConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// What net/http negotiates by default, the config returned to clients must keep it
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+	}
+	if r.config.ClientCAFile != "" {
+		r.mu.RLock()
+		config.ClientCAs = r.clientCAs
+		r.mu.RUnlock()
+		// Probes and metrics scrapers usually have no client certificate,
+		// the routes which need one are wrapped with RequireClientCert
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+// RequireClientCert rejects requests without a verified client certificate with 401 Unauthorized
+// when a client CA is configured
+func (r *Reloader) RequireClientCert(next http.Handler) http.Handler {
+	if r.config.ClientCAFile == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			http.Error(w, ErrClientCertRequired.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Reload loads the files again when their content changed, it returns true if they were reloaded.
+// On error the previous certificate and client CAs are kept.
+func (r *Reloader) Reload() (bool, error) {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	contents := [][]byte{}
+	for _, filename := range files {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return false, err
+		}
+		contents = append(contents, content)
+	}
+
+	r.mu.RLock()
+	unchanged := len(r.loaded) == len(contents)
+	for i := 0; unchanged && i < len(contents); i++ {
+		unchanged = bytes.Equal(r.loaded[i], contents[i])
+	}
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		return false, fmt.Errorf("error loading %s and %s: %s", r.config.CertFile, r.config.KeyFile, err.Error())
+	}
+	var clientCAs *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(contents[2]) {
+			return false, fmt.Errorf("%s: %s", ErrInvalidClientCA.Error(), r.config.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.loaded = contents
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Watch reloads the files every ReloadInterval until ctx is done
+func (r *Reloader) Watch(ctx context.Context) {
+	ticker := time.NewTicker(r.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.Reload()
+		if err != nil {
+			// Files may be read in the middle of a rotation, they are checked again on the next tick
+			log.Warnf("error reloading TLS files, keeping the current ones: %s", err.Error())
+			continue
+		}
+		if reloaded {
+			log.Infof("reloaded TLS certificate %s", r.config.CertFile)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert is a certificate with its key, signed by parent or self-signed when parent is nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, serial int64, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("akouste-%d", serial)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	assert.NoError(t, err)
+	return cert
+}
+
+func (c *testCert) write(t *testing.T, dir string) {
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tls.crt"), c.certPEM(), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tls.key"), c.keyPEM(t), 0600))
+}
+
+// serve starts a TLS server using reloader, as cmd/downloader does, and returns its URL
+func serve(t *testing.T, reloader *Reloader) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{
+		Handler: reloader.RequireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("PONG\n"))
+		})),
+		TLSConfig: reloader.TLSConfig(),
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+	}
+	go server.ServeTLS(listener, "", "")
+	return "https://" + listener.Addr().String(), func() { server.Close() }
+}
+
+// newClient returns a client trusting ca, authenticated with clientCert when not nil
+func newClient(ca *testCert, clientCert *tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientConfig := &tls.Config{RootCAs: roots}
+	if clientCert != nil {
+		clientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	// Connections are not reused so every request sees the current certificate
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig, DisableKeepAlives: true}}
+}
+
+func servedSerial(t *testing.T, client *http.Client, url string) int64 {
+	resp, err := client.Get(url)
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	defer resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+}
+
+func statusCode(t *testing.T, client *http.Client, url string) int {
+	resp, err := client.Get(url)
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, 1, true, nil)
+	newTestCert(t, 10, false, ca).write(t, dir)
+	reloader, err := New(Config{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")})
+	assert.NoError(t, err)
+
+	url, closeServer := serve(t, reloader)
+	defer closeServer()
+	client := newClient(ca, nil)
+	assert.Equal(t, int64(10), servedSerial(t, client, url))
+
+	reloaded, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	newTestCert(t, 11, false, ca).write(t, dir)
+	reloaded, err = reloader.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, int64(11), servedSerial(t, client, url))
+
+	// A half written rotation keeps the current certificate
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "tls.key"), []byte("partial"), 0600))
+	_, err = reloader.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, int64(11), servedSerial(t, client, url))
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, 1, true, nil)
+	clientCA := newTestCert(t, 2, true, nil)
+	otherCA := newTestCert(t, 3, true, nil)
+	newTestCert(t, 10, false, ca).write(t, dir)
+	clientCAFile := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, ioutil.WriteFile(clientCAFile, clientCA.certPEM(), 0644))
+
+	reloader, err := New(Config{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: clientCAFile,
+	})
+	assert.NoError(t, err)
+
+	trusted := newTestCert(t, 20, false, clientCA).tlsCertificate(t)
+	untrusted := newTestCert(t, 21, false, otherCA).tlsCertificate(t)
+
+	url, closeServer := serve(t, reloader)
+	defer closeServer()
+	client := newClient(ca, &trusted)
+	assert.Equal(t, int64(10), servedSerial(t, client, url))
+
+	// Connections without a trusted client certificate are accepted, their requests are not
+	assert.Equal(t, http.StatusUnauthorized, statusCode(t, newClient(ca, nil), url))
+	other := newClient(ca, &untrusted)
+	assert.Equal(t, http.StatusUnauthorized, statusCode(t, other, url))
+
+	// Rotating the client CA applies to the next connections
+	assert.NoError(t, ioutil.WriteFile(clientCAFile, otherCA.certPEM(), 0644))
+	reloaded, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, http.StatusOK, statusCode(t, other, url))
+	assert.Equal(t, http.StatusUnauthorized, statusCode(t, client, url))
+}
+
+func TestHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "akouste-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, 1, true, nil)
+	clientCA := newTestCert(t, 2, true, nil)
+	newTestCert(t, 10, false, ca).write(t, dir)
+	clientCAFile := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, ioutil.WriteFile(clientCAFile, clientCA.certPEM(), 0644))
+	trusted := newTestCert(t, 20, false, clientCA).tlsCertificate(t)
+
+	for _, config := range []Config{
+		{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")},
+		{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key"), ClientCAFile: clientCAFile},
+	} {
+		reloader, err := New(config)
+		assert.NoError(t, err)
+		url, closeServer := serve(t, reloader)
+
+		client := newClient(ca, &trusted)
+		client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+		resp, err := client.Get(url)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, 2, resp.ProtoMajor, "client CA %q", config.ClientCAFile)
+		}
+		closeServer()
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New(Config{CertFile: "tls.crt"})
+	assert.Equal(t, ErrMissingKeyPair, err)
+	_, err = New(Config{CertFile: "/does/not/exist.crt", KeyFile: "/does/not/exist.key"})
+	assert.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "akouste-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	newTestCert(t, 10, false, nil).write(t, dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), []byte("not a certificate"), 0644))
+	_, err = New(Config{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	})
+	assert.Error(t, err)
+}
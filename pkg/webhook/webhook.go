@@ -0,0 +1,241 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/albertwidi/akouste/pkg/log"
+)
+
+// Error variables
+var (
+	ErrQueueFull  = errors.New("webhook queue full")
+	ErrHTTPStatus = errors.New("unexpected http status")
+	ErrClosed     = errors.New("webhook notifier closed")
+)
+
+// Headers of the webhook requests
+const (
+	// HeaderSignature holds 'sha256=' followed by the hex encoded HMAC-SHA256 of the body
+	HeaderSignature = "X-Akouste-Signature"
+	// HeaderEvent holds the type of the event
+	HeaderEvent = "X-Akouste-Event"
+)
+
+// List of event types
+const (
+	EventDownload = "download"
+	EventExtract  = "extract"
+	EventPrune    = "prune"
+	EventFailure  = "failure"
+)
+
+// Default configuration values
+const (
+	defaultMaxAttempts = 5
+	defaultBackoff     = time.Second
+	maxBackoff         = time.Minute
+	queueSize          = 100
+)
+
+// Event is posted as JSON to the webhook URLs
+type Event struct {
+	Type string `json:"type"`
+	// Node the event happened on, the hostname by default
+	Node string    `json:"node"`
+	Time time.Time `json:"time"`
+	URI  string    `json:"uri,omitempty"`
+	// Name of the version in the download directory
+	Version string `json:"version,omitempty"`
+	// Path of the version directory, or of the downloaded file when not unarchived
+	Dir      string `json:"dir,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	// Duration of the operation in nanoseconds
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	// Machine-readable code of the error
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// Config of a Notifier
+type Config struct {
+	// URLs the events are posted to
+	URLs []string
+
+	// Key of the HMAC-SHA256 signature of the requests, requests are not signed when empty
+	Secret []byte
+
+	// Number of times a request is sent before the event is dropped, defaults to 5
+	MaxAttempts int
+
+	// Delay before the first retry, doubled after every attempt, defaults to 1s
+	Backoff time.Duration
+
+	// Node reported in the events, defaults to the hostname
+	Node string
+
+	// Client sending the requests, defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// Notifier posts events to webhook URLs in the background.
+// Events are delivered to each URL in order, a slow URL does not delay the others.
+type Notifier struct {
+	config    Config
+	endpoints []*endpoint
+	wg        sync.WaitGroup
+
+	// mu guards closed, Notify holds it for reading while it queues an event
+	mu     sync.RWMutex
+	closed bool
+}
+
+// endpoint is a webhook URL with its queue of events
+type endpoint struct {
+	url   string
+	queue chan Event
+}
+
+// New returns a Notifier sending to config.URLs, it must be closed to flush pending events
+func New(config Config) *Notifier {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = defaultBackoff
+	}
+	if config.Node == "" {
+		config.Node, _ = os.Hostname()
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	n := &Notifier{config: config}
+	for _, url := range config.URLs {
+		e := &endpoint{url: url, queue: make(chan Event, queueSize)}
+		n.endpoints = append(n.endpoints, e)
+		n.wg.Add(1)
+		go n.deliver(e)
+	}
+	return n
+}
+
+// Notify queues event for every URL without blocking, events are dropped when a queue is full
+func (n *Notifier) Notify(event Event) {
+	if event.Node == "" {
+		event.Node = n.config.Node
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		log.Warnf("%s: dropped %s event", ErrClosed.Error(), event.Type)
+		return
+	}
+	for _, e := range n.endpoints {
+		select {
+		case e.queue <- event:
+		default:
+			log.Warnf("%s: dropped %s event to %s", ErrQueueFull.Error(), event.Type, e.url)
+		}
+	}
+}
+
+// Close waits until the queued events are sent, the events notified afterward are dropped
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		for _, e := range n.endpoints {
+			close(e.queue)
+		}
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+// deliver sends the events queued for e until its queue is closed
+func (n *Notifier) deliver(e *endpoint) {
+	defer n.wg.Done()
+	for event := range e.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Warnf("error encoding %s event: %s", event.Type, err.Error())
+			continue
+		}
+
+		delay := n.config.Backoff
+		for attempt := 1; ; attempt++ {
+			err = n.send(e.url, event.Type, body)
+			if err == nil {
+				break
+			}
+			if attempt >= n.config.MaxAttempts {
+				log.Warnf("error sending %s event to %s, dropped after %d attempts: %s", event.Type, e.url, attempt, err.Error())
+				break
+			}
+			log.Debugf("error sending %s event to %s, retrying in %s: %s", event.Type, e.url, delay, err.Error())
+			time.Sleep(delay)
+			if delay *= 2; delay > maxBackoff {
+				delay = maxBackoff
+			}
+		}
+	}
+}
+
+// send posts body to url
+func (n *Notifier) send(url, eventType string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, eventType)
+	if len(n.config.Secret) > 0 {
+		req.Header.Set(HeaderSignature, Sign(n.config.Secret, body))
+	}
+
+	resp, err := n.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", ErrHTTPStatus.Error(), resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the value of the signature header of body
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns true if signature, the value of the signature header, matches body
+func Verify(secret, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver records the events posted to it, failing the first failures requests
+type receiver struct {
+	t        *testing.T
+	secret   []byte
+	mu       sync.Mutex
+	failures int
+	attempts int
+	events   []Event
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.attempts++
+	if rc.attempts <= rc.failures {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	assert.NoError(rc.t, err)
+	if rc.secret != nil {
+		assert.True(rc.t, Verify(rc.secret, body, r.Header.Get(HeaderSignature)))
+	} else {
+		assert.Empty(rc.t, r.Header.Get(HeaderSignature))
+	}
+	var event Event
+	assert.NoError(rc.t, json.Unmarshal(body, &event))
+	assert.Equal(rc.t, event.Type, r.Header.Get(HeaderEvent))
+	rc.events = append(rc.events, event)
+}
+
+func TestNotify(t *testing.T) {
+	secret := []byte("secret")
+	signed := &receiver{t: t, secret: secret}
+	signedServer := httptest.NewServer(signed)
+	defer signedServer.Close()
+
+	n := New(Config{URLs: []string{signedServer.URL}, Secret: secret, Node: "node-1"})
+	n.Notify(Event{Type: EventDownload, URI: "config-1.tar.gz", Checksum: "sha256:abcd", Duration: time.Second})
+	n.Notify(Event{Type: EventExtract, URI: "config-1.tar.gz", Version: "config-1"})
+	n.Notify(Event{Type: EventFailure, URI: "config-2.tar.gz", Error: "checksum mismatch"})
+	n.Close()
+
+	assert.Len(t, signed.events, 3)
+	for i, eventType := range []string{EventDownload, EventExtract, EventFailure} {
+		assert.Equal(t, eventType, signed.events[i].Type)
+		assert.Equal(t, "node-1", signed.events[i].Node)
+		assert.False(t, signed.events[i].Time.IsZero())
+	}
+	assert.Equal(t, "sha256:abcd", signed.events[0].Checksum)
+	assert.Equal(t, time.Second, signed.events[0].Duration)
+	assert.Equal(t, "checksum mismatch", signed.events[2].Error)
+
+	// Events notified after Close are dropped
+	n.Notify(Event{Type: EventDownload, URI: "config-3.tar.gz"})
+	n.Close()
+	assert.Len(t, signed.events, 3)
+}
+
+func TestNotifyRetry(t *testing.T) {
+	flaky := &receiver{t: t, failures: 2}
+	flakyServer := httptest.NewServer(flaky)
+	defer flakyServer.Close()
+	down := &receiver{t: t, failures: 100}
+	downServer := httptest.NewServer(down)
+	defer downServer.Close()
+
+	n := New(Config{
+		URLs:        []string{flakyServer.URL, downServer.URL},
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+	})
+	n.Notify(Event{Type: EventPrune, Version: "config-1"})
+	n.Close()
+
+	assert.Equal(t, 3, flaky.attempts)
+	assert.Len(t, flaky.events, 1)
+	assert.Equal(t, "config-1", flaky.events[0].Version)
+	assert.Equal(t, 3, down.attempts)
+	assert.Empty(t, down.events)
+}
+
+func TestSignVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"type":"download"}`)
+	signature := Sign(secret, body)
+
+	assert.True(t, Verify(secret, body, signature))
+	assert.False(t, Verify([]byte("other"), body, signature))
+	assert.False(t, Verify(secret, []byte(`{"type":"prune"}`), signature))
+	assert.False(t, Verify(secret, body, signature[len("sha256="):]))
+	assert.False(t, Verify(secret, body, ""))
+}